@@ -0,0 +1,260 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// =====================
+// Account Deletion & Data Export
+// =====================
+
+// Deleting an account keeps the users row as an anonymous tombstone
+// ("Deleted player"), so finished games, ratings and head-to-head records
+// stay intact for the opponents. Everything that identifies the person —
+// names, email, password, profile, avatar, sessions, friends and blocks —
+// is removed, and their chat and direct messages keep neither name nor text.
+// Nobody can befriend, message, challenge or invite a deleted account.
+
+const deletedDisplayName = "Deleted player"
+
+// Anonymize turns the account into a tombstone and returns the avatar key
+// and friend IDs it had, for cleanup outside the transaction.
+func (s *UserStore) Anonymize(userID int64) (avatarKey string, friendIDs []int64, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+
+	var key sql.NullString
+	err = tx.QueryRow(
+		`SELECT avatar_key FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`,
+		userID,
+	).Scan(&key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rows, err := tx.Query(
+		`SELECT CASE WHEN requester_id = $1 THEN addressee_id ELSE requester_id END
+           FROM friendships
+          WHERE (requester_id = $1 OR addressee_id = $1) AND accepted_at IS NOT NULL`,
+		userID,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return "", nil, err
+		}
+		friendIDs = append(friendIDs, id)
+	}
+	rows.Close()
+
+	stmts := []string{
+		// '!' is never a bcrypt hash, so no password matches it
+		`UPDATE users SET username = 'deleted-' || id, display_name = '` + deletedDisplayName + `',
+		        password_hash = '!', email = NULL, email_verified_at = NULL,
+		        bio = '', country = '', colors = '[]', avatar_key = NULL, avatar_url = NULL,
+		        is_admin = FALSE, locked_until = NULL, username_skeleton = NULL, display_skeleton = NULL,
+		        deleted_at = now()
+		  WHERE id = $1`,
+		`UPDATE chat_messages SET display_name = '` + deletedDisplayName + `', message = '' WHERE user_id = $1`,
+		`UPDATE direct_messages SET sender_name = '` + deletedDisplayName + `', message = '' WHERE sender_id = $1`,
+		`UPDATE lobby_rooms SET owner_id = NULL WHERE owner_id = $1`,
+		`DELETE FROM lobby_room_members WHERE user_id = $1`,
+		`DELETE FROM friendships WHERE requester_id = $1 OR addressee_id = $1`,
+		`DELETE FROM user_blocks WHERE user_id = $1 OR target_id = $1`,
+		`UPDATE sessions SET device = '', ip = '', user_agent = '' WHERE user_id = $1`,
+		`DELETE FROM refresh_tokens WHERE user_id = $1`,
+		`DELETE FROM password_resets WHERE user_id = $1`,
+		`DELETE FROM user_stats WHERE user_id = $1`,
+		`DELETE FROM user_board_stats WHERE user_id = $1`,
+		// invite games nobody else has joined yet go away entirely
+		`DELETE FROM games g WHERE g.status = 'pending' AND g.created_by = $1
+		    AND NOT EXISTS (SELECT 1 FROM game_players p
+		                     WHERE p.game_id = g.id AND p.user_id IS NOT NULL AND p.user_id <> $1)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			return "", nil, err
+		}
+	}
+	return key.String, friendIDs, tx.Commit()
+}
+
+// Deleted reports whether userID belongs to a deleted account. An unknown
+// ID counts as deleted.
+func (s *UserStore) Deleted(userID int64) (bool, error) {
+	var deleted bool
+	err := s.db.QueryRow(`SELECT deleted_at IS NOT NULL FROM users WHERE id = $1`, userID).Scan(&deleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	}
+	return deleted, err
+}
+
+type deleteAccountReq struct {
+	Password string `json:"password"`
+}
+
+// DELETE /api/me (protected) anonymizes the account after checking the
+// password
+func (s *Server) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+
+	var req deleteAccountReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+		writeError(w, 400, "confirm with your password")
+		return
+	}
+	hash, err := s.userStore.PasswordHash(uid)
+	if err != nil {
+		log.Println("PasswordHash error:", err)
+		writeError(w, 500, "failed to delete account")
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		writeError(w, 403, "password is wrong")
+		return
+	}
+
+	avatarKey, friendIDs, err := s.userStore.Anonymize(uid)
+	if err != nil {
+		log.Println("Anonymize error:", err)
+		writeError(w, 500, "failed to delete account")
+		return
+	}
+	// only now, so a failed deletion leaves the user logged in
+	s.revokeUserSessions(uid, "")
+	s.dropBlob(avatarKey)
+	s.refreshFriendCaches(friendIDs...)
+	audit(s.db, "account_deleted", uid, getIP(r), "")
+
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// exportQueries are the parts of a data export, one JSON file each.
+var exportQueries = []struct {
+	name  string
+	query string
+}{
+	{"account", `SELECT id, username, display_name, email, email_verified_at, rating, bio, country,
+	                    colors, avatar_url, created_at
+	               FROM users WHERE id = $1`},
+	{"sessions", `SELECT id, device, ip, user_agent, created_at, last_seen_at, revoked_at
+	                FROM sessions WHERE user_id = $1 ORDER BY created_at`},
+	{"games", `SELECT g.id, g.status, g.settings, g.rated, g.created_at, g.started_at, g.finished_at,
+	                  p.seat, p.score, p.place, p.rating_delta,
+	                  (SELECT json_agg(json_build_object('seat', o.seat, 'userId', o.user_id) ORDER BY o.seat)
+	                     FROM game_players o WHERE o.game_id = g.id) AS players
+	             FROM game_players p JOIN games g ON g.id = p.game_id
+	            WHERE p.user_id = $1 ORDER BY g.created_at`},
+	{"moves", `SELECT game_id, edge_id, player_slot, created_at, retracted_at
+	             FROM moves WHERE user_id = $1 ORDER BY id`},
+	{"chat", `SELECT room_type, room, game_id, team, message, created_at
+	            FROM chat_messages WHERE user_id = $1 ORDER BY id`},
+	{"direct_messages", `SELECT sender_id, recipient_id, message, created_at, read_at
+	                       FROM direct_messages WHERE sender_id = $1 OR recipient_id = $1 ORDER BY id`},
+	{"friends", `SELECT requester_id, addressee_id, created_at, accepted_at
+	               FROM friendships WHERE requester_id = $1 OR addressee_id = $1`},
+	{"blocks", `SELECT target_id, kind, created_at FROM user_blocks WHERE user_id = $1`},
+	{"stats", `SELECT games, wins, losses, draws, boxes, longest_chain, moves, move_ms
+	             FROM user_stats WHERE user_id = $1`},
+}
+
+// queryRecords returns every row as a column -> value map. JSON columns
+// are passed through as JSON rather than as strings.
+func queryRecords(db *sql.DB, query string, args ...any) ([]map[string]any, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	records := []map[string]any{}
+	for rows.Next() {
+		values := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		rec := make(map[string]any, len(cols))
+		for i, col := range cols {
+			if b, ok := values[i].([]byte); ok && json.Valid(b) {
+				values[i] = json.RawMessage(b)
+			} else if ok {
+				values[i] = string(b)
+			}
+			rec[col] = values[i]
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// GET /api/me/export (protected) returns everything stored about the user,
+// as a ZIP of JSON files or, with ?format=json, as one JSON document
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+
+	parts := make(map[string][]map[string]any, len(exportQueries))
+	for _, q := range exportQueries {
+		records, err := queryRecords(s.db, q.query, uid)
+		if err != nil {
+			log.Println("export", q.name, "error:", err)
+			writeError(w, 500, "failed to export data")
+			return
+		}
+		parts[q.name] = records
+	}
+	audit(s.db, "data_exported", uid, getIP(r), "")
+
+	exportedAt := time.Now().UTC()
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, 200, map[string]any{"exportedAt": exportedAt, "data": parts})
+		return
+	}
+
+	name := "dots-and-boxes-export-" + strconv.FormatInt(uid, 10) + "-" + exportedAt.Format("20060102") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.WriteHeader(200)
+
+	zw := zip.NewWriter(w)
+	for _, q := range exportQueries {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: q.name + ".json", Method: zip.Deflate, Modified: exportedAt})
+		if err != nil {
+			log.Println("export zip error:", err)
+			return
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(parts[q.name]); err != nil {
+			log.Println("export zip error:", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Println("export zip error:", err)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// =====================
+// Refresh Tokens & Revocation
+// =====================
+
+// A login starts a session. The client holds a short-lived access token
+// (a JWT carrying the session ID as "sid") and a refresh token that is
+// swapped for a new pair on every use. Presenting a refresh token twice
+// means it leaked, so the whole session is revoked — unless it comes within
+// refreshReuseGrace of its first use while its replacement is still unused,
+// which is what several tabs refreshing at once look like.
+
+const (
+	accessTokenTTL    = 15 * time.Minute
+	refreshTokenTTL   = 30 * 24 * time.Hour
+	refreshReuseGrace = 30 * time.Second
+)
+
+var (
+	errRefreshInvalid = errors.New("invalid refresh token")
+	errRefreshReused  = errors.New("refresh token reused")
+	errSessionRevoked = errors.New("session revoked")
+)
+
+// sessionRevocations lets parseJWT reject access tokens of revoked
+// sessions without a database round trip. Entries only need to outlive the
+// longest access token.
+type sessionRevocations struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time // sessionID -> when it can be forgotten
+}
+
+func newSessionRevocations() *sessionRevocations {
+	return &sessionRevocations{revoked: make(map[string]time.Time)}
+}
+
+var revokedSessions = newSessionRevocations()
+
+func (sr *sessionRevocations) add(sessionID string) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	now := time.Now()
+	for id, until := range sr.revoked {
+		if now.After(until) {
+			delete(sr.revoked, id)
+		}
+	}
+	sr.revoked[sessionID] = now.Add(accessTokenTTL)
+}
+
+func (sr *sessionRevocations) has(sessionID string) bool {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	_, ok := sr.revoked[sessionID]
+	return ok
+}
+
+// loadRevokedSessions restores the revocations whose access tokens may
+// still be unexpired, so a restart doesn't revive them.
+func loadRevokedSessions(db *sql.DB) error {
+	rows, err := db.Query(
+		`SELECT DISTINCT session_id FROM refresh_tokens
+          WHERE revoked_at > now() - $1 * interval '1 second'`,
+		int(accessTokenTTL.Seconds()),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		revokedSessions.add(id)
+	}
+	return rows.Err()
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRefreshToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// RefreshStore keeps hashes of refresh tokens; the tokens themselves are
+// only ever seen by the client.
+type RefreshStore struct {
+	db *sql.DB
+}
+
+func NewRefreshStore(db *sql.DB) *RefreshStore {
+	return &RefreshStore{db: db}
+}
+
+func (s *RefreshStore) Issue(userID int64, sessionID string) (string, error) {
+	token := newRefreshToken()
+	_, err := s.db.Exec(
+		`INSERT INTO refresh_tokens (token_hash, session_id, user_id, expires_at)
+         VALUES ($1, $2, $3, $4)`,
+		hashToken(token), sessionID, userID, time.Now().UTC().Add(refreshTokenTTL),
+	)
+	return token, err
+}
+
+// Rotate consumes token and issues its replacement in the same session. A
+// token that was already used revokes the session and returns
+// errRefreshReused along with the session ID, except during the grace
+// window described above, where it gets another replacement.
+func (s *RefreshStore) Rotate(token string) (userID int64, sessionID, next string, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer tx.Rollback()
+
+	var expiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	var replacedBy sql.NullString
+	var inGrace bool
+	err = tx.QueryRow(
+		`SELECT user_id, session_id, expires_at, used_at, revoked_at, replaced_by,
+                COALESCE(used_at > now() - $2 * interval '1 second', FALSE)
+           FROM refresh_tokens
+          WHERE token_hash = $1
+          FOR UPDATE`,
+		hashToken(token), int(refreshReuseGrace.Seconds()),
+	).Scan(&userID, &sessionID, &expiresAt, &usedAt, &revokedAt, &replacedBy, &inGrace)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", "", errRefreshInvalid
+	}
+	if err != nil {
+		return 0, "", "", err
+	}
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return 0, "", "", errRefreshInvalid
+	}
+
+	if usedAt.Valid {
+		// another tab already swapped it a moment ago: only the token it
+		// got may have been used since, not anything further down the chain
+		latest := false
+		if inGrace && replacedBy.Valid {
+			err := tx.QueryRow(
+				`SELECT used_at IS NULL AND revoked_at IS NULL FROM refresh_tokens WHERE token_hash = $1`,
+				replacedBy.String,
+			).Scan(&latest)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return 0, "", "", err
+			}
+		}
+		if !latest {
+			if _, err := tx.Exec(
+				`UPDATE refresh_tokens SET revoked_at = now() WHERE session_id = $1 AND revoked_at IS NULL`,
+				sessionID,
+			); err != nil {
+				return 0, "", "", err
+			}
+			if err := tx.Commit(); err != nil {
+				return 0, "", "", err
+			}
+			return userID, sessionID, "", errRefreshReused
+		}
+	}
+
+	next = newRefreshToken()
+	if !usedAt.Valid {
+		if _, err := tx.Exec(
+			`UPDATE refresh_tokens SET used_at = now(), replaced_by = $2 WHERE token_hash = $1`,
+			hashToken(token), hashToken(next),
+		); err != nil {
+			return 0, "", "", err
+		}
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO refresh_tokens (token_hash, session_id, user_id, expires_at)
+         VALUES ($1, $2, $3, $4)`,
+		hashToken(next), sessionID, userID, time.Now().UTC().Add(refreshTokenTTL),
+	); err != nil {
+		return 0, "", "", err
+	}
+	return userID, sessionID, next, tx.Commit()
+}
+
+// SessionOf returns the session an unrevoked refresh token belongs to,
+// used or not.
+func (s *RefreshStore) SessionOf(token string) (string, error) {
+	var sessionID string
+	err := s.db.QueryRow(
+		`SELECT session_id FROM refresh_tokens WHERE token_hash = $1 AND revoked_at IS NULL`,
+		hashToken(token),
+	).Scan(&sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errRefreshInvalid
+	}
+	return sessionID, err
+}
+
+func (s *RefreshStore) RevokeSession(sessionID string) error {
+	_, err := s.db.Exec(
+		`UPDATE refresh_tokens SET revoked_at = now() WHERE session_id = $1 AND revoked_at IS NULL`,
+		sessionID,
+	)
+	return err
+}
+
+// issueTokens returns the access/refresh pair sent to the client.
+func (s *Server) issueTokens(userID int64, sessionID string, refresh string) (map[string]any, error) {
+	access, err := generateJWT(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if refresh == "" {
+		if refresh, err = s.refreshStore.Issue(userID, sessionID); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]any{
+		"token":        access,
+		"refreshToken": refresh,
+		"expiresIn":    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// revokeSession kills a session everywhere: its refresh tokens stop
+// working, its access tokens are rejected and its sockets are closed.
+func (s *Server) revokeSession(sessionID string) error {
+	if err := s.refreshStore.RevokeSession(sessionID); err != nil {
+		return err
+	}
+	s.dropSession(sessionID)
+	return nil
+}
+
+// dropSession rejects the session's access tokens from now on and closes
+// its live sockets.
+func (s *Server) dropSession(sessionID string) {
+	if err := s.sessionStore.MarkRevoked(sessionID); err != nil {
+		log.Println("MarkRevoked error:", err)
+	}
+	revokedSessions.add(sessionID)
+	s.lobbyHub.kicks <- sessionID
+	s.gameHub.kicks <- sessionID
+}
+
+type refreshReq struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// POST /auth/refresh swaps a refresh token for a new token pair
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	var req refreshReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		writeError(w, 400, "missing refreshToken")
+		return
+	}
+
+	userID, sessionID, next, err := s.refreshStore.Rotate(req.RefreshToken)
+	switch {
+	case errors.Is(err, errRefreshReused):
+		log.Printf("refresh token reused, revoking session %s of user %d", sessionID, userID)
+		s.dropSession(sessionID)
+		writeError(w, 401, "invalid refresh token")
+		return
+	case errors.Is(err, errRefreshInvalid):
+		writeError(w, 401, "invalid refresh token")
+		return
+	case err != nil:
+		log.Println("Rotate error:", err)
+		writeError(w, 500, "failed to refresh token")
+		return
+	}
+
+	if err := s.sessionStore.Touch(sessionID, getIP(r)); err != nil {
+		log.Println("Touch session error:", err)
+	}
+
+	tokens, err := s.issueTokens(userID, sessionID, next)
+	if err != nil {
+		writeError(w, 500, "failed to create token")
+		return
+	}
+	writeJSON(w, 200, tokens)
+}
+
+// POST /auth/logout ends the session of the refresh token in the body, or
+// of the bearer access token if no refresh token is given
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	var req refreshReq
+	json.NewDecoder(r.Body).Decode(&req)
+
+	var sessionID string
+	if req.RefreshToken != "" {
+		id, err := s.refreshStore.SessionOf(req.RefreshToken)
+		if err != nil && !errors.Is(err, errRefreshInvalid) {
+			log.Println("SessionOf error:", err)
+			writeError(w, 500, "failed to log out")
+			return
+		}
+		sessionID = id
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		if _, id, err := parseAccessToken(strings.TrimPrefix(auth, "Bearer ")); err == nil {
+			sessionID = id
+		}
+	}
+
+	// Logging out of a session that is already gone is not an error
+	if sessionID != "" {
+		if err := s.revokeSession(sessionID); err != nil {
+			log.Println("revokeSession error:", err)
+			writeError(w, 500, "failed to log out")
+			return
+		}
+	}
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// newSessionID names a login session; see sessions.go.
+func newSessionID() string {
+	return uuid.NewString()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// =====================
+// Blob Store
+// =====================
+
+// BlobStore keeps uploaded files such as avatars. Keys are relative paths
+// like "avatars/42-<uuid>.png"; URL is where clients can fetch one.
+type BlobStore interface {
+	Put(key string, data []byte, contentType string) error
+	Delete(key string) error
+	URL(key string) string
+}
+
+// newBlobStoreFromEnv stores files under MEDIA_DIR (default "data/media"),
+// served by this server at /media/ unless MEDIA_BASE_URL points elsewhere
+// (a CDN or bucket in front of the same directory).
+func newBlobStoreFromEnv() *diskBlobStore {
+	dir := os.Getenv("MEDIA_DIR")
+	if dir == "" {
+		dir = filepath.Join("data", "media")
+	}
+	base := os.Getenv("MEDIA_BASE_URL")
+	if base == "" {
+		base = strings.TrimRight(os.Getenv("PUBLIC_API_URL"), "/") + "/media"
+	}
+	return &diskBlobStore{dir: dir, baseURL: strings.TrimRight(base, "/")}
+}
+
+type diskBlobStore struct {
+	dir     string
+	baseURL string
+}
+
+func (b *diskBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if clean == "." || filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+		return "", errors.New("invalid blob key")
+	}
+	return filepath.Join(b.dir, clean), nil
+}
+
+func (b *diskBlobStore) Put(key string, data []byte, contentType string) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// write then rename so readers never see half a file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (b *diskBlobStore) Delete(key string) error {
+	path, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (b *diskBlobStore) URL(key string) string {
+	return b.baseURL + "/" + key
+}
+
+// Handler serves the stored files, without directory listings.
+func (b *diskBlobStore) Handler() http.Handler {
+	files := http.FileServer(http.Dir(b.dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// =====================
+// Blocks & Mutes
+// =====================
+
+// A block stops challenges and DMs in both directions, ends any friendship
+// and hides the blocked user's lobby chat. A mute only hides their lobby
+// chat.
+const (
+	relationBlock = "block"
+	relationMute  = "mute"
+)
+
+type BlockStore struct {
+	db *sql.DB
+}
+
+func NewBlockStore(db *sql.DB) *BlockStore {
+	return &BlockStore{db: db}
+}
+
+func (s *BlockStore) Add(userID, targetID int64, kind string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO user_blocks (user_id, target_id, kind)
+         VALUES ($1, $2, $3)
+         ON CONFLICT (user_id, target_id, kind) DO NOTHING`,
+		userID, targetID, kind,
+	)
+	return err
+}
+
+func (s *BlockStore) Remove(userID, targetID int64, kind string) error {
+	_, err := s.db.Exec(
+		`DELETE FROM user_blocks WHERE user_id = $1 AND target_id = $2 AND kind = $3`,
+		userID, targetID, kind,
+	)
+	return err
+}
+
+// List returns the IDs userID has blocked or muted, depending on kind.
+func (s *BlockStore) List(userID int64, kind string) ([]int64, error) {
+	rows, err := s.db.Query(
+		`SELECT target_id FROM user_blocks
+          WHERE user_id = $1 AND kind = $2
+          ORDER BY created_at ASC`,
+		userID, kind,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Ignored returns everyone whose lobby chat userID should not see: the
+// users they blocked or muted.
+func (s *BlockStore) Ignored(userID int64) (map[int64]bool, error) {
+	rows, err := s.db.Query(
+		`SELECT target_id FROM user_blocks WHERE user_id = $1`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ignored := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ignored[id] = true
+	}
+	return ignored, rows.Err()
+}
+
+// EitherBlocked reports whether a has blocked b or b has blocked a.
+func (s *BlockStore) EitherBlocked(a, b int64) (bool, error) {
+	var blocked bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS (
+			SELECT 1 FROM user_blocks
+			 WHERE kind = 'block'
+			   AND ((user_id = $1 AND target_id = $2) OR (user_id = $2 AND target_id = $1))
+		)`,
+		a, b,
+	).Scan(&blocked)
+	return blocked, err
+}
+
+// lobbyIgnoreUpdate replaces the ignore list on every lobby connection of a
+// user after they block, mute, unblock or unmute somebody.
+type lobbyIgnoreUpdate struct {
+	userID  int64
+	ignored map[int64]bool
+}
+
+func (h *LobbyHub) applyIgnoreUpdate(u lobbyIgnoreUpdate) {
+	for c := range h.clients {
+		if c.user.ID == u.userID {
+			c.ignored = u.ignored
+		}
+	}
+}
+
+// unreachable is used by the lobby socket before relaying a challenge, DM
+// or room invite: it reports a block either way or a deleted account. When
+// that can't be read it answers true: better to refuse a message than to
+// deliver one a block should have stopped.
+func (c *LobbyClient) unreachable(otherID int64) bool {
+	if c.db == nil {
+		return false
+	}
+	blocked, err := NewBlockStore(c.db).EitherBlocked(c.user.ID, otherID)
+	if err != nil {
+		log.Println("EitherBlocked error:", err)
+		return true
+	}
+	deleted, err := NewUserStore(c.db).Deleted(otherID)
+	if err != nil {
+		log.Println("Deleted error:", err)
+		return true
+	}
+	return blocked || deleted
+}
+
+// GET /api/blocks (protected)
+func (s *Server) handleListBlocks(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+
+	blocked, err := s.blockStore.List(uid, relationBlock)
+	if err != nil {
+		writeError(w, 500, "failed to load blocks")
+		return
+	}
+	muted, err := s.blockStore.List(uid, relationMute)
+	if err != nil {
+		writeError(w, 500, "failed to load mutes")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"blocked": blocked, "muted": muted})
+}
+
+// POST/DELETE /api/blocks/{userId} and /api/mutes/{userId} (protected)
+func (s *Server) handleSetRelation(kind string, add bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid := r.Context().Value("userId").(int64)
+
+		targetID, err := strconv.ParseInt(r.PathValue("userId"), 10, 64)
+		if err != nil || targetID <= 0 || targetID == uid {
+			writeError(w, 400, "invalid userId")
+			return
+		}
+
+		if add {
+			err = s.blockStore.Add(uid, targetID, kind)
+		} else {
+			err = s.blockStore.Remove(uid, targetID, kind)
+		}
+		if err != nil {
+			writeError(w, 500, "failed to update "+kind)
+			return
+		}
+		// a block ends any friendship, so friend notifications stop too
+		if add && kind == relationBlock {
+			if err := s.friendStore.Remove(uid, targetID); err != nil {
+				log.Println("Remove friend error:", err)
+			}
+			s.refreshFriendCaches(uid, targetID)
+		}
+
+		ignored, err := s.blockStore.Ignored(uid)
+		if err != nil {
+			writeError(w, 500, "failed to update "+kind)
+			return
+		}
+		s.lobbyHub.ignores <- lobbyIgnoreUpdate{userID: uid, ignored: ignored}
+
+		writeJSON(w, 200, map[string]any{"ok": true})
+	}
+}
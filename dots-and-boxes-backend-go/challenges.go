@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// =====================
+// Challenges
+// =====================
+
+// A challenge invites 1-3 players at once; the game starts when every one
+// of them has accepted. Open challenges live here on the server, so the
+// answer only carries the challenge ID and the settings can't be changed
+// on the way back.
+
+const groupChallengeTTL = 5 * time.Minute
+
+type groupChallenge struct {
+	ID        string
+	FromID    int64
+	TargetIDs []int64
+	Accepted  map[int64]bool
+	Settings  GameSettings
+	ExpiresAt time.Time
+}
+
+// participants lists the challenger first, then the invitees in seat order.
+func (gc *groupChallenge) participants() []int64 {
+	return append([]int64{gc.FromID}, gc.TargetIDs...)
+}
+
+type challengeBook struct {
+	mu         sync.Mutex
+	challenges map[string]*groupChallenge
+}
+
+func newChallengeBook() *challengeBook {
+	return &challengeBook{challenges: make(map[string]*groupChallenge)}
+}
+
+var groupChallenges = newChallengeBook()
+
+// open records a new challenge from fromID to targetIDs.
+func (b *challengeBook) open(fromID int64, targetIDs []int64, settings GameSettings) *groupChallenge {
+	gc := &groupChallenge{
+		ID:        uuid.NewString(),
+		FromID:    fromID,
+		TargetIDs: targetIDs,
+		Accepted:  make(map[int64]bool),
+		Settings:  settings,
+		ExpiresAt: time.Now().Add(groupChallengeTTL),
+	}
+	b.add(gc)
+	return gc
+}
+
+func (b *challengeBook) add(gc *groupChallenge) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for id, old := range b.challenges {
+		if now.After(old.ExpiresAt) {
+			delete(b.challenges, id)
+		}
+	}
+	b.challenges[gc.ID] = gc
+}
+
+// accept records userID's acceptance. When everybody has accepted the
+// challenge is removed and returned with ready set.
+func (b *challengeBook) accept(id string, userID int64) (gc *groupChallenge, ready bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	gc, ok := b.challenges[id]
+	if !ok || time.Now().After(gc.ExpiresAt) {
+		delete(b.challenges, id)
+		return nil, false
+	}
+	invited := false
+	for _, t := range gc.TargetIDs {
+		if t == userID {
+			invited = true
+		}
+	}
+	if !invited {
+		return nil, false
+	}
+
+	gc.Accepted[userID] = true
+	if len(gc.Accepted) < len(gc.TargetIDs) {
+		return gc, false
+	}
+	delete(b.challenges, id)
+	return gc, true
+}
+
+// cancel removes the challenge if userID takes part in it.
+func (b *challengeBook) cancel(id string, userID int64) *groupChallenge {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	gc, ok := b.challenges[id]
+	if !ok {
+		return nil
+	}
+	for _, p := range gc.participants() {
+		if p == userID {
+			delete(b.challenges, id)
+			return gc
+		}
+	}
+	return nil
+}
+
+// challengeSettings applies a challenge's optional settings (board size,
+// variant, ...) to a game with the given number of seats.
+func challengeSettings(requested *GameSettings, seats int) (GameSettings, error) {
+	var settings GameSettings
+	if requested != nil {
+		settings = *requested
+	}
+	settings.Seats = seats
+	if err := settings.normalize(); err != nil {
+		return settings, err
+	}
+	return settings, settings.checkConnected()
+}
+
+// startLobbyGame creates and registers an active game with the given seats
+// and tells every player's lobby connections to open it.
+func (c *LobbyClient) startLobbyGame(playerIDs []int64, settings GameSettings) {
+	g := &Game{
+		ID:        uuid.NewString(),
+		Status:    "active",
+		Settings:  settings,
+		PlayerIDs: playerIDs,
+		CreatedBy: c.user.ID,
+	}
+	if c.db != nil {
+		if err := NewGameStore(c.db).CreateGame(g); err != nil {
+			log.Println("CreateGame error:", err)
+			// without a row nothing of the game could be saved
+			data, err := json.Marshal(map[string]string{"type": "error", "text": "failed to start game"})
+			if err == nil {
+				c.hub.broadcast <- lobbyOutbound{Data: data, UserIDs: playerIDs}
+			}
+			return
+		}
+	}
+	gameRegistry.Register(g.ID, g.PlayerIDs)
+
+	start := LobbyStartGame{
+		Type:      "startGame",
+		GameID:    g.ID,
+		PlayerIDs: g.PlayerIDs,
+		Settings:  &g.Settings,
+	}
+	out, err := json.Marshal(start)
+	if err != nil {
+		return
+	}
+	c.hub.broadcast <- lobbyOutbound{Data: out, UserIDs: start.PlayerIDs}
+}
+
+// handleGroupChallenge sends a multi-player challenge to every invitee.
+func (c *LobbyClient) handleGroupChallenge(payload LobbyInbound) {
+	targets := make([]int64, 0, len(payload.TargetUserIDs))
+	seen := map[int64]bool{c.user.ID: true}
+	for _, id := range payload.TargetUserIDs {
+		if id == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		targets = append(targets, id)
+	}
+	if len(targets) == 0 || len(targets) > maxSeats-1 {
+		c.sendError("invite 1 to 3 other players")
+		return
+	}
+	for _, id := range targets {
+		if c.unreachable(id) {
+			c.sendError("you can't challenge one of those players")
+			return
+		}
+	}
+	// as with a 1v1 challenge: friends from any room, anyone else from here
+	room := c.Room()
+	var strangers []int64
+	for _, id := range targets {
+		if !c.isFriend(id) {
+			strangers = append(strangers, id)
+		}
+	}
+	if len(strangers) > 0 {
+		q := lobbyOnlineQuery{userIDs: strangers, room: room, reply: make(chan map[int64]LobbyUser, 1)}
+		c.hub.onlineQueries <- q
+		if here := <-q.reply; len(here) < len(strangers) {
+			c.sendError("you can only challenge friends or players in this room")
+			return
+		}
+	}
+
+	settings, err := challengeSettings(payload.Settings, len(targets)+1)
+	if err != nil {
+		c.sendError(err.Error())
+		return
+	}
+
+	gc := groupChallenges.open(c.user.ID, targets, settings)
+
+	fromName := c.user.DisplayName
+	if fromName == "" {
+		fromName = c.user.Username
+	}
+	offer := LobbyChallengeOffer{
+		Type:          "challengeOffer",
+		Room:          room,
+		ChallengeID:   gc.ID,
+		FromUserID:    c.user.ID,
+		FromName:      fromName,
+		TargetUserIDs: targets,
+		Settings:      &gc.Settings,
+	}
+	out, err := json.Marshal(offer)
+	if err != nil {
+		return
+	}
+	c.hub.broadcast <- lobbyOutbound{Data: out, UserIDs: gc.participants()}
+}
+
+// handleChallengeAnswer deals with challengeAccept / challengeDecline.
+func (c *LobbyClient) handleChallengeAnswer(payload LobbyInbound) {
+	if payload.Type == "challengeDecline" {
+		gc := groupChallenges.cancel(payload.ChallengeID, c.user.ID)
+		if gc == nil {
+			return
+		}
+		out, err := json.Marshal(map[string]any{
+			"type":        "challengeCancelled",
+			"challengeId": gc.ID,
+			"userId":      c.user.ID,
+		})
+		if err == nil {
+			c.hub.broadcast <- lobbyOutbound{Data: out, UserIDs: gc.participants()}
+		}
+		return
+	}
+
+	gc, ready := groupChallenges.accept(payload.ChallengeID, c.user.ID)
+	if gc == nil {
+		return
+	}
+	if ready {
+		c.startLobbyGame(gc.participants(), gc.Settings)
+		return
+	}
+
+	out, err := json.Marshal(map[string]any{
+		"type":        "challengeAccepted",
+		"challengeId": gc.ID,
+		"userId":      c.user.ID,
+	})
+	if err == nil {
+		c.hub.broadcast <- lobbyOutbound{Data: out, UserIDs: gc.participants()}
+	}
+}
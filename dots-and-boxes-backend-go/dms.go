@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =====================
+// Direct Messages
+// =====================
+
+const dmMaxLength = 2000
+
+type DirectMessage struct {
+	Type       string     `json:"type"` // "dm"
+	ID         int64      `json:"id"`
+	FromUserID int64      `json:"fromUserId"`
+	FromName   string     `json:"fromName"`
+	ToUserID   int64      `json:"toUserId"`
+	Text       string     `json:"text"`
+	SentAt     time.Time  `json:"sentAt"`
+	ReadAt     *time.Time `json:"readAt,omitempty"`
+}
+
+func saveDirectMessage(db *sql.DB, m *DirectMessage) error {
+	if db == nil {
+		m.SentAt = time.Now().UTC()
+		return nil
+	}
+	return db.QueryRow(
+		`INSERT INTO direct_messages (sender_id, recipient_id, sender_name, message)
+         VALUES ($1, $2, $3, $4)
+         RETURNING id, created_at`,
+		m.FromUserID, m.ToUserID, m.FromName, m.Text,
+	).Scan(&m.ID, &m.SentAt)
+}
+
+// loadDirectMessages returns the conversation between two users, paged the
+// same way as lobby chat: older than before (0 for newest), oldest first.
+func loadDirectMessages(db *sql.DB, userID, otherID, before int64, limit int) ([]DirectMessage, error) {
+	if db == nil {
+		return nil, nil
+	}
+
+	rows, err := db.Query(
+		`SELECT id, sender_id, sender_name, recipient_id, message, created_at, read_at
+           FROM direct_messages
+          WHERE LEAST(sender_id, recipient_id) = LEAST($1::BIGINT, $2::BIGINT)
+            AND GREATEST(sender_id, recipient_id) = GREATEST($1::BIGINT, $2::BIGINT)
+            AND ($3 = 0 OR id < $3)
+          ORDER BY id DESC
+          LIMIT $4`,
+		userID, otherID, before, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []DirectMessage
+	for rows.Next() {
+		m := DirectMessage{Type: "dm"}
+		var readAt sql.NullTime
+		if err := rows.Scan(&m.ID, &m.FromUserID, &m.FromName, &m.ToUserID, &m.Text, &m.SentAt, &readAt); err != nil {
+			return nil, err
+		}
+		if readAt.Valid {
+			m.ReadAt = &readAt.Time
+		}
+		msgs = append(msgs, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, nil
+}
+
+// markDirectMessagesRead marks everything otherID sent to userID as read.
+func markDirectMessagesRead(db *sql.DB, userID, otherID int64) error {
+	if db == nil {
+		return nil
+	}
+	_, err := db.Exec(
+		`UPDATE direct_messages SET read_at = now()
+          WHERE recipient_id = $1 AND sender_id = $2 AND read_at IS NULL`,
+		userID, otherID,
+	)
+	return err
+}
+
+// unreadDirectMessageCounts maps sender ID to the number of unread messages
+// they have sent userID, leaving out senders userID has blocked.
+func unreadDirectMessageCounts(db *sql.DB, userID int64) (map[int64]int, error) {
+	counts := make(map[int64]int)
+	if db == nil {
+		return counts, nil
+	}
+
+	rows, err := db.Query(
+		`SELECT sender_id, COUNT(*)
+           FROM direct_messages
+          WHERE recipient_id = $1 AND read_at IS NULL
+            AND NOT EXISTS (SELECT 1 FROM user_blocks b
+                             WHERE b.user_id = $1 AND b.target_id = direct_messages.sender_id AND b.kind = 'block')
+          GROUP BY sender_id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var senderID int64
+		var n int
+		if err := rows.Scan(&senderID, &n); err != nil {
+			return nil, err
+		}
+		counts[senderID] = n
+	}
+	return counts, rows.Err()
+}
+
+// handleDirectMessage stores a "dm" from the lobby socket and delivers it to
+// every connection of both participants.
+func (c *LobbyClient) handleDirectMessage(payload LobbyInbound) {
+	txt := strings.TrimSpace(payload.Text)
+	if payload.TargetUserID == 0 || payload.TargetUserID == c.user.ID || txt == "" {
+		return
+	}
+	if len(txt) > dmMaxLength {
+		c.sendError("message too long")
+		return
+	}
+	if c.unreachable(payload.TargetUserID) {
+		c.sendError("you can't message this player")
+		return
+	}
+
+	fromName := c.user.DisplayName
+	if fromName == "" {
+		fromName = c.user.Username
+	}
+
+	dm := DirectMessage{
+		Type:       "dm",
+		FromUserID: c.user.ID,
+		FromName:   fromName,
+		ToUserID:   payload.TargetUserID,
+		Text:       txt,
+	}
+	if err := saveDirectMessage(c.db, &dm); err != nil {
+		log.Println("saveDirectMessage error:", err)
+		c.sendError("failed to send message")
+		return
+	}
+
+	out, err := json.Marshal(dm)
+	if err != nil {
+		return
+	}
+	c.hub.broadcast <- lobbyOutbound{Data: out, UserIDs: []int64{c.user.ID, dm.ToUserID}}
+}
+
+// GET /api/dms/{userId}?before=<messageId>&limit=<n> (protected)
+func (s *Server) handleDirectMessages(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+
+	otherID, err := strconv.ParseInt(r.PathValue("userId"), 10, 64)
+	if err != nil || otherID <= 0 {
+		writeError(w, 400, "invalid userId")
+		return
+	}
+
+	var before int64
+	if v := r.URL.Query().Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, 400, "invalid before")
+			return
+		}
+		before = n
+	}
+
+	limit := lobbyChatJoinHistory
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, 400, "invalid limit")
+			return
+		}
+		limit = min(n, lobbyChatMaxPage)
+	}
+
+	msgs, err := loadDirectMessages(s.db, uid, otherID, before, limit)
+	if err != nil {
+		writeError(w, 500, "failed to load messages")
+		return
+	}
+
+	// Reading the newest page counts as having seen the conversation
+	if before == 0 {
+		if err := markDirectMessagesRead(s.db, uid, otherID); err != nil {
+			log.Println("markDirectMessagesRead error:", err)
+		}
+	}
+
+	var nextBefore int64
+	if len(msgs) == limit {
+		nextBefore = msgs[0].ID
+	}
+	if msgs == nil {
+		msgs = []DirectMessage{}
+	}
+	writeJSON(w, 200, map[string]any{
+		"messages":   msgs,
+		"nextBefore": nextBefore,
+	})
+}
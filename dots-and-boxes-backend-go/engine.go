@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// =====================
+// Game Engine
+// =====================
+
+// Edge IDs match the frontend: "h-<row>-<col>" for the horizontal edge on
+// dot row <row>, "v-<row>-<col>" for the vertical edge on dot column <col>.
+// Box "b-<row>-<col>" is bounded by h-row-col, h-(row+1)-col, v-row-col and
+// v-row-(col+1).
+
+var (
+	errUnknownEdge = errors.New("no such edge")
+	errEdgeTaken   = errors.New("edge already drawn")
+	errNotYourTurn = errors.New("not your turn")
+	errGameOver    = errors.New("game is over")
+)
+
+type edgeRef struct {
+	kind     byte // 'h' or 'v'
+	row, col int
+}
+
+func parseEdgeID(id string) (edgeRef, bool) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 3 || (parts[0] != "h" && parts[0] != "v") {
+		return edgeRef{}, false
+	}
+	row, err1 := strconv.Atoi(parts[1])
+	col, err2 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil {
+		return edgeRef{}, false
+	}
+	return edgeRef{kind: parts[0][0], row: row, col: col}, true
+}
+
+func (e edgeRef) id() string {
+	return fmt.Sprintf("%c-%d-%d", e.kind, e.row, e.col)
+}
+
+func boxID(row, col int) string {
+	return fmt.Sprintf("b-%d-%d", row, col)
+}
+
+// GameState is the server's copy of a board, rebuilt from the moves table.
+type GameState struct {
+	Settings  GameSettings
+	PlayerIDs []int64 // seat order; seat i plays slot seatSlot(i)
+
+	Edges map[string]string // edgeID -> slot that drew it
+	Boxes map[string]string // boxID -> slot that completed it
+	Moves []StoredMove      // applied moves, oldest first
+	Turn  string            // slot to move next
+
+	rules     RuleSet
+	takeback  *takebackRequest // pending request, cleared by any move
+	resigned  bool             // a player ended the game before the last box
+	turnStart int              // index in Moves of the first move of the latest turn
+	chained   bool             // the last move earned another, so the turn goes on
+}
+
+func seatSlot(i int) string {
+	return "p" + strconv.Itoa(i+1)
+}
+
+func NewGameState(settings GameSettings, playerIDs []int64) *GameState {
+	first := 0
+	if len(settings.TurnOrder) > 0 {
+		first = settings.TurnOrder[0]
+	}
+	st := &GameState{
+		Settings:  settings,
+		PlayerIDs: playerIDs,
+		Edges:     make(map[string]string),
+		Boxes:     make(map[string]string),
+		Turn:      seatSlot(first),
+		rules:     rulesFor(settings),
+	}
+	for _, e := range st.rules.InitialEdges(st) {
+		st.Edges[e.id()] = borderSlot
+	}
+	return st
+}
+
+// seats is the number of seats in play, at least two for old games.
+func (st *GameState) seats() int {
+	return max(st.Settings.Seats, len(st.PlayerIDs), minSeats)
+}
+
+// SlotFor returns the slot userID plays, or "" if they aren't seated.
+func (st *GameState) SlotFor(userID int64) string {
+	for i, id := range st.PlayerIDs {
+		if id != 0 && id == userID {
+			return seatSlot(i)
+		}
+	}
+	return ""
+}
+
+// seated reports whether the game record seats anybody. Only the demo
+// board, which the database doesn't know, has no seated players.
+func (st *GameState) seated() bool {
+	for _, id := range st.PlayerIDs {
+		if id != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// validEdge reports whether e exists: it must border at least one box the
+// layout keeps.
+func (st *GameState) validEdge(e edgeRef) bool {
+	return len(st.boxesBeside(e)) > 0
+}
+
+func (st *GameState) totalBoxes() int {
+	n := 0
+	for row := range st.Settings.BoardHeight {
+		for col := range st.Settings.BoardWidth {
+			if st.Settings.boxEnabled(row, col) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Over reports whether every box has been claimed.
+func (st *GameState) Over() bool {
+	return st.resigned || len(st.Boxes) == st.totalBoxes()
+}
+
+// boxesBeside lists the (row, col) of the layout's boxes an edge borders.
+func (st *GameState) boxesBeside(e edgeRef) [][2]int {
+	var out [][2]int
+	add := func(row, col int) {
+		if st.Settings.boxEnabled(row, col) {
+			out = append(out, [2]int{row, col})
+		}
+	}
+	if e.kind == 'h' {
+		add(e.row-1, e.col)
+		add(e.row, e.col)
+	} else {
+		add(e.row, e.col-1)
+		add(e.row, e.col)
+	}
+	return out
+}
+
+func boxEdges(row, col int) []edgeRef {
+	return []edgeRef{
+		{'h', row, col}, {'h', row + 1, col},
+		{'v', row, col}, {'v', row, col + 1},
+	}
+}
+
+func (st *GameState) boxComplete(row, col int) bool {
+	for _, e := range boxEdges(row, col) {
+		if st.Edges[e.id()] == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// slotSeat is the inverse of seatSlot.
+func slotSeat(slot string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(slot, "p"))
+	return n - 1
+}
+
+// nextSlot follows the configured turn order, or plain seat order.
+func (st *GameState) nextSlot(slot string) string {
+	seat := slotSeat(slot)
+
+	order := st.Settings.TurnOrder
+	for i, s := range order {
+		if s == seat {
+			return seatSlot(order[(i+1)%len(order)])
+		}
+	}
+	return seatSlot((seat + 1) % st.seats())
+}
+
+// Apply draws edgeID for slot and returns the boxes it completed.
+func (st *GameState) Apply(edgeID, slot string) ([]string, error) {
+	if st.Over() {
+		return nil, errGameOver
+	}
+	if slot != st.Turn {
+		return nil, errNotYourTurn
+	}
+	e, ok := parseEdgeID(edgeID)
+	if !ok || !st.validEdge(e) {
+		return nil, errUnknownEdge
+	}
+	if st.Edges[edgeID] != "" {
+		return nil, errEdgeTaken
+	}
+	if err := st.rules.Legal(st, e); err != nil {
+		return nil, err
+	}
+
+	st.Edges[edgeID] = slot
+	var completed []string
+	for _, b := range st.boxesBeside(e) {
+		if st.boxComplete(b[0], b[1]) {
+			id := boxID(b[0], b[1])
+			st.Boxes[id] = slot
+			completed = append(completed, id)
+		}
+	}
+
+	// Completing a box earns another move unless the variant says
+	// otherwise; team games may hand it to the mover's partner
+	if len(completed) == 0 || !st.rules.ExtraTurn() {
+		st.Turn = st.nextSlot(slot)
+	} else if st.Settings.ExtraTurn == extraTurnPartner {
+		st.Turn = st.partnerSlot(slot)
+	}
+	// A turn is a move plus every extra move it earned, whoever on the
+	// team made them
+	if !st.chained {
+		st.turnStart = len(st.Moves)
+	}
+	st.chained = len(completed) > 0 && st.rules.ExtraTurn()
+	st.Moves = append(st.Moves, StoredMove{EdgeID: edgeID, PlayerSlot: slot})
+	st.takeback = nil
+	return completed, nil
+}
+
+// undoLast rebuilds the board without the last applied move, for when it
+// could not be stored.
+func (st *GameState) undoLast() {
+	if len(st.Moves) == 0 {
+		return
+	}
+	rebuilt := NewGameState(st.Settings, st.PlayerIDs)
+	rebuilt.Replay(st.Moves[:len(st.Moves)-1])
+	*st = *rebuilt
+}
+
+// Replay applies stored moves in order. Moves that don't fit (for example
+// from before the server validated moves) are skipped.
+func (st *GameState) Replay(moves []StoredMove) {
+	for _, m := range moves {
+		if _, err := st.Apply(m.EdgeID, m.PlayerSlot); err != nil {
+			continue
+		}
+		st.Moves[len(st.Moves)-1].ID = m.ID
+	}
+}
+
+// Scores counts boxes per slot.
+func (st *GameState) Scores() map[string]int {
+	scores := make(map[string]int)
+	for i := range st.seats() {
+		scores[seatSlot(i)] = 0
+	}
+	for _, slot := range st.Boxes {
+		scores[slot]++
+	}
+	return scores
+}
+
+// SeatScores counts boxes per seat, in seat order.
+func (st *GameState) SeatScores() []int {
+	scores := make([]int, st.seats())
+	for _, slot := range st.Boxes {
+		n, _ := strconv.Atoi(strings.TrimPrefix(slot, "p"))
+		if n >= 1 && n <= len(scores) {
+			scores[n-1]++
+		}
+	}
+	return scores
+}
+
+// lastTurnStart is the index of the first move of the last turn, chained
+// captures included, also when the extra moves went to a partner.
+func (st *GameState) lastTurnStart() int {
+	return st.turnStart
+}
+
+// Snapshot is the "state" message sent after the board was rewritten.
+func (st *GameState) Snapshot(gameID string) GameMove {
+	moves := st.Moves
+	if moves == nil {
+		moves = []StoredMove{}
+	}
+	return GameMove{
+		Type:   "state",
+		GameID: gameID,
+		Moves:  moves,
+		Turn:   st.Turn,
+		Scores: st.Scores(),
+
+		TeamScores:   teamScores(st.Settings, st.SeatScores()),
+		InitialEdges: st.initialEdgeIDs(),
+	}
+}
+
+// initialEdgeIDs lists the edges the variant drew before the first move.
+func (st *GameState) initialEdgeIDs() []string {
+	var ids []string
+	for _, e := range st.rules.InitialEdges(st) {
+		ids = append(ids, e.id())
+	}
+	return ids
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"testing"
+)
+
+type testMove struct {
+	edge, slot string
+}
+
+// newTestState builds a normalized w x h game for two players.
+func newTestState(t *testing.T, settings GameSettings) *GameState {
+	t.Helper()
+	if err := settings.normalize(); err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	return NewGameState(settings, []int64{1, 2})
+}
+
+// playAll applies moves that must all succeed.
+func playAll(t *testing.T, st *GameState, moves []testMove) {
+	t.Helper()
+	for _, m := range moves {
+		if _, err := st.Apply(m.edge, m.slot); err != nil {
+			t.Fatalf("Apply(%s, %s): %v", m.edge, m.slot, err)
+		}
+	}
+}
+
+// threeSides draws three sides of b-0-0 on a 2x2 board, leaving v-0-1 for p2.
+var threeSides = []testMove{{"h-0-0", "p1"}, {"h-1-0", "p2"}, {"v-0-0", "p1"}}
+
+func TestApply(t *testing.T) {
+	fullBoard := []testMove{
+		{"h-0-0", "p1"}, {"h-0-1", "p2"}, {"h-2-0", "p1"}, {"h-2-1", "p2"},
+		{"v-0-0", "p1"}, {"v-0-2", "p2"}, {"v-1-0", "p1"}, {"v-1-2", "p2"},
+		{"h-1-0", "p1"}, {"h-1-1", "p2"}, {"v-0-1", "p1"},
+	}
+
+	tests := []struct {
+		name      string
+		setup     []testMove
+		move      testMove
+		wantErr   error
+		wantTurn  string
+		wantBoxes map[string]string
+	}{
+		{name: "first move passes the turn", move: testMove{"h-0-0", "p1"}, wantTurn: "p2", wantBoxes: map[string]string{}},
+		{name: "out of turn", move: testMove{"h-0-0", "p2"}, wantErr: errNotYourTurn},
+		{name: "edge off the board", move: testMove{"h-3-0", "p1"}, wantErr: errUnknownEdge},
+		{name: "malformed edge", move: testMove{"x-0-0", "p1"}, wantErr: errUnknownEdge},
+		{name: "edge drawn twice", setup: []testMove{{"h-0-0", "p1"}}, move: testMove{"h-0-0", "p2"}, wantErr: errEdgeTaken},
+		{
+			name:      "completing a box earns another move",
+			setup:     threeSides,
+			move:      testMove{"v-0-1", "p2"},
+			wantTurn:  "p2",
+			wantBoxes: map[string]string{"b-0-0": "p2"},
+		},
+		{
+			name:      "last edge completes two boxes",
+			setup:     fullBoard,
+			move:      testMove{"v-1-1", "p1"},
+			wantTurn:  "p1",
+			wantBoxes: map[string]string{"b-0-0": "p1", "b-0-1": "p1", "b-1-0": "p1", "b-1-1": "p1"},
+		},
+		{
+			name:    "no moves after the last box",
+			setup:   append(append([]testMove{}, fullBoard...), testMove{"v-1-1", "p1"}),
+			move:    testMove{"h-0-0", "p1"},
+			wantErr: errGameOver,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newTestState(t, GameSettings{BoardWidth: 2, BoardHeight: 2})
+			playAll(t, st, tt.setup)
+
+			_, err := st.Apply(tt.move.edge, tt.move.slot)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Apply error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if len(st.Moves) != len(tt.setup) {
+					t.Errorf("failed move was recorded: %d moves, want %d", len(st.Moves), len(tt.setup))
+				}
+				return
+			}
+			if st.Turn != tt.wantTurn {
+				t.Errorf("Turn = %s, want %s", st.Turn, tt.wantTurn)
+			}
+			if !maps.Equal(st.Boxes, tt.wantBoxes) {
+				t.Errorf("Boxes = %v, want %v", st.Boxes, tt.wantBoxes)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeDB stands in for Postgres in handler tests. Every statement goes to
+// answer, which returns the rows for a query (nil for none) or an error.
+type fakeDB struct {
+	mu     sync.Mutex
+	answer func(query string, args []any) (*fakeRows, error)
+}
+
+func newFakeDB(t *testing.T, answer func(query string, args []any) (*fakeRows, error)) *sql.DB {
+	db := sql.OpenDB(&fakeDB{answer: answer})
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func (f *fakeDB) run(query string, named []driver.NamedValue) (*fakeRows, error) {
+	args := make([]any, len(named))
+	for i, nv := range named {
+		args[i] = nv.Value
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows, err := f.answer(query, args)
+	if rows == nil && err == nil {
+		rows = &fakeRows{}
+	}
+	return rows, err
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return fakeDriver{} }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) { return nil, errors.New("use sql.OpenDB") }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)           { return fakeTx{}, nil }
+
+func (c fakeConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (c fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.db.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	copied := *rows
+	return &copied, nil
+}
+
+func (c fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if _, err := c.db.run(query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+// fakeRows is a result set: column names and one value slice per row.
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// oneRow is a single-row result with unnamed columns.
+func oneRow(values ...driver.Value) *fakeRows {
+	return &fakeRows{cols: make([]string, len(values)), rows: [][]driver.Value{values}}
+}
+
+// useTestKeys signs tokens with a fixed HS256 secret for the test.
+func useTestKeys(t *testing.T) {
+	t.Helper()
+	t.Setenv("JWT_KEYS_FILE", "")
+	t.Setenv("JWT_SECRET", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=") // 32 bytes
+	keys, err := loadKeyRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtKeys = keys
+}
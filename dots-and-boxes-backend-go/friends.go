@@ -0,0 +1,418 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// =====================
+// Friends
+// =====================
+
+// A friendship row is written by the requester; it becomes mutual once the
+// other user accepts it.
+type Friend struct {
+	UserID      int64     `json:"userId"`
+	DisplayName string    `json:"displayName"`
+	Since       time.Time `json:"since"`
+	Online      bool      `json:"online"`
+	Status      string    `json:"status,omitempty"` // lobby status when online
+}
+
+type FriendList struct {
+	Friends  []Friend `json:"friends"`
+	Incoming []Friend `json:"incoming"` // requests waiting for my answer
+	Outgoing []Friend `json:"outgoing"` // requests I sent
+}
+
+type FriendStore struct {
+	db *sql.DB
+}
+
+func NewFriendStore(db *sql.DB) *FriendStore {
+	return &FriendStore{db: db}
+}
+
+// Request sends a friend request, or accepts the opposite pending request if
+// targetID already asked. accepted reports whether they are now friends;
+// between friends it changes nothing.
+func (s *FriendStore) Request(userID, targetID int64) (accepted bool, err error) {
+	if friends, err := s.AreFriends(userID, targetID); err != nil || friends {
+		return friends, err
+	}
+	accepted, err = s.Accept(userID, targetID)
+	if err != nil || accepted {
+		return accepted, err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO friendships (requester_id, addressee_id)
+         VALUES ($1, $2)
+         ON CONFLICT (requester_id, addressee_id) DO NOTHING`,
+		userID, targetID,
+	)
+	return false, err
+}
+
+// Accept accepts the pending request requesterID sent to userID.
+func (s *FriendStore) Accept(userID, requesterID int64) (bool, error) {
+	res, err := s.db.Exec(
+		`UPDATE friendships SET accepted_at = now()
+          WHERE requester_id = $1 AND addressee_id = $2 AND accepted_at IS NULL`,
+		requesterID, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Remove deletes a friendship or a pending request in either direction.
+func (s *FriendStore) Remove(userID, otherID int64) error {
+	_, err := s.db.Exec(
+		`DELETE FROM friendships
+          WHERE (requester_id = $1 AND addressee_id = $2)
+             OR (requester_id = $2 AND addressee_id = $1)`,
+		userID, otherID,
+	)
+	return err
+}
+
+func (s *FriendStore) AreFriends(a, b int64) (bool, error) {
+	var ok bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS (
+			SELECT 1 FROM friendships
+			 WHERE accepted_at IS NOT NULL
+			   AND ((requester_id = $1 AND addressee_id = $2) OR (requester_id = $2 AND addressee_id = $1))
+		)`,
+		a, b,
+	).Scan(&ok)
+	return ok, err
+}
+
+// FriendIDs returns the set of accepted friends of userID.
+func (s *FriendStore) FriendIDs(userID int64) (map[int64]bool, error) {
+	rows, err := s.db.Query(
+		`SELECT CASE WHEN requester_id = $1 THEN addressee_id ELSE requester_id END
+           FROM friendships
+          WHERE accepted_at IS NOT NULL AND (requester_id = $1 OR addressee_id = $1)`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// List returns friends and pending requests, without online information.
+func (s *FriendStore) List(userID int64) (*FriendList, error) {
+	rows, err := s.db.Query(
+		`SELECT f.requester_id, f.addressee_id, f.accepted_at, f.created_at, u.id, u.display_name
+           FROM friendships f
+           JOIN users u ON u.id = CASE WHEN f.requester_id = $1 THEN f.addressee_id ELSE f.requester_id END
+          WHERE f.requester_id = $1 OR f.addressee_id = $1
+          ORDER BY u.display_name ASC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := &FriendList{Friends: []Friend{}, Incoming: []Friend{}, Outgoing: []Friend{}}
+	for rows.Next() {
+		var requesterID, addresseeID int64
+		var acceptedAt sql.NullTime
+		var createdAt time.Time
+		var f Friend
+		if err := rows.Scan(&requesterID, &addresseeID, &acceptedAt, &createdAt, &f.UserID, &f.DisplayName); err != nil {
+			return nil, err
+		}
+		switch {
+		case acceptedAt.Valid:
+			f.Since = acceptedAt.Time
+			list.Friends = append(list.Friends, f)
+		case requesterID == userID:
+			f.Since = createdAt
+			list.Outgoing = append(list.Outgoing, f)
+		default:
+			f.Since = createdAt
+			list.Incoming = append(list.Incoming, f)
+		}
+	}
+	return list, rows.Err()
+}
+
+// lobbyFriendsUpdate replaces the cached friend set on a user's connections.
+type lobbyFriendsUpdate struct {
+	userID  int64
+	friends map[int64]bool
+}
+
+// lobbyOnlineQuery asks the hub for the presence of some users; users who
+// aren't connected are missing from the reply.
+type lobbyOnlineQuery struct {
+	userIDs []int64
+	room    string // only look in this room; "" for any
+	reply   chan map[int64]LobbyUser
+}
+
+// lobbyGameOver is sent when a game ends so friends of the players hear of it.
+type lobbyGameOver struct {
+	GameID    string
+	PlayerIDs []int64
+	Ratings   map[int64]int // new ratings after a rated game
+}
+
+func (h *LobbyHub) applyFriendsUpdate(u lobbyFriendsUpdate) {
+	for c := range h.clients {
+		if c.user.ID == u.userID {
+			c.friends = u.friends
+		}
+	}
+}
+
+func (h *LobbyHub) answerOnlineQuery(q lobbyOnlineQuery) {
+	out := make(map[int64]LobbyUser)
+	for _, id := range q.userIDs {
+		for room, users := range h.presence {
+			if q.room != "" && room != q.room {
+				continue
+			}
+			if u, ok := users[id]; ok {
+				out[id] = u
+				break
+			}
+		}
+	}
+	q.reply <- out
+}
+
+// isOnline reports whether userID has any lobby connection.
+func (h *LobbyHub) isOnline(userID int64) bool {
+	for c := range h.clients {
+		if c.user.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyFriends sends data to every connection whose owner is friends with
+// userID.
+func (h *LobbyHub) notifyFriends(userID int64, data []byte) {
+	for c := range h.clients {
+		if c.friends[userID] {
+			h.sendTo(c, data)
+		}
+	}
+}
+
+func (h *LobbyHub) announceOnline(client *LobbyClient) {
+	displayName := client.user.DisplayName
+	if displayName == "" {
+		displayName = client.user.Username
+	}
+	data, err := json.Marshal(map[string]any{
+		"type":        "friendOnline",
+		"userId":      client.user.ID,
+		"displayName": displayName,
+	})
+	if err != nil {
+		return
+	}
+	h.notifyFriends(client.user.ID, data)
+}
+
+func (h *LobbyHub) announceGameOver(g lobbyGameOver) {
+	for id, rating := range g.Ratings {
+		if h.isOnline(id) {
+			h.ratings[id] = rating
+			h.refreshPresence(id)
+		}
+	}
+	for _, id := range g.PlayerIDs {
+		data, err := json.Marshal(map[string]any{
+			"type":   "friendGameOver",
+			"userId": id,
+			"gameId": g.GameID,
+		})
+		if err != nil {
+			continue
+		}
+		h.notifyFriends(id, data)
+	}
+}
+
+// isFriend is checked on the lobby read goroutine, so it asks the database
+// rather than the hub-owned cache.
+func (c *LobbyClient) isFriend(otherID int64) bool {
+	if c.db == nil {
+		return false
+	}
+	ok, err := NewFriendStore(c.db).AreFriends(c.user.ID, otherID)
+	if err != nil {
+		log.Println("AreFriends error:", err)
+		return false
+	}
+	return ok
+}
+
+// refreshFriendCaches reloads both users' friend sets in the lobby hub.
+func (s *Server) refreshFriendCaches(userIDs ...int64) {
+	for _, id := range userIDs {
+		friends, err := s.friendStore.FriendIDs(id)
+		if err != nil {
+			log.Println("FriendIDs error:", err)
+			continue
+		}
+		s.lobbyHub.friendUpdates <- lobbyFriendsUpdate{userID: id, friends: friends}
+	}
+}
+
+// notifyUser pushes a lobby socket event to all of a user's connections.
+func (s *Server) notifyUser(userID int64, event any) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	s.lobbyHub.broadcast <- lobbyOutbound{Data: data, UserIDs: []int64{userID}}
+}
+
+func friendTargetID(w http.ResponseWriter, r *http.Request, uid int64) (int64, bool) {
+	targetID, err := strconv.ParseInt(r.PathValue("userId"), 10, 64)
+	if err != nil || targetID <= 0 || targetID == uid {
+		writeError(w, 400, "invalid userId")
+		return 0, false
+	}
+	return targetID, true
+}
+
+// GET /api/friends (protected)
+func (s *Server) handleListFriends(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+
+	list, err := s.friendStore.List(uid)
+	if err != nil {
+		writeError(w, 500, "failed to load friends")
+		return
+	}
+
+	ids := make([]int64, len(list.Friends))
+	for i, f := range list.Friends {
+		ids[i] = f.UserID
+	}
+	q := lobbyOnlineQuery{userIDs: ids, reply: make(chan map[int64]LobbyUser, 1)}
+	s.lobbyHub.onlineQueries <- q
+	online := <-q.reply
+	for i := range list.Friends {
+		if p, ok := online[list.Friends[i].UserID]; ok {
+			list.Friends[i].Online = true
+			list.Friends[i].Status = p.Status
+		}
+	}
+
+	writeJSON(w, 200, list)
+}
+
+// POST /api/friends/{userId} (protected) sends or accepts a request
+func (s *Server) handleFriendRequest(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+	targetID, ok := friendTargetID(w, r, uid)
+	if !ok {
+		return
+	}
+
+	if blocked, err := s.blockStore.EitherBlocked(uid, targetID); err != nil || blocked {
+		writeError(w, 403, "can't befriend this user")
+		return
+	}
+	deleted, err := s.userStore.Deleted(targetID)
+	if err != nil {
+		log.Println("Deleted error:", err)
+		writeError(w, 500, "failed to send friend request")
+		return
+	}
+	if deleted {
+		writeError(w, 404, "user not found")
+		return
+	}
+
+	friends, err := s.friendStore.AreFriends(uid, targetID)
+	if err != nil {
+		writeError(w, 500, "failed to send friend request")
+		return
+	}
+	if friends {
+		writeJSON(w, 200, map[string]any{"accepted": true})
+		return
+	}
+
+	accepted, err := s.friendStore.Request(uid, targetID)
+	if err != nil {
+		writeError(w, 500, "failed to send friend request")
+		return
+	}
+
+	if accepted {
+		s.refreshFriendCaches(uid, targetID)
+		s.notifyUser(targetID, map[string]any{"type": "friendAccepted", "userId": uid})
+	} else {
+		s.notifyUser(targetID, map[string]any{"type": "friendRequest", "userId": uid})
+	}
+	writeJSON(w, 200, map[string]any{"accepted": accepted})
+}
+
+// POST /api/friends/{userId}/accept (protected)
+func (s *Server) handleFriendAccept(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+	requesterID, ok := friendTargetID(w, r, uid)
+	if !ok {
+		return
+	}
+
+	accepted, err := s.friendStore.Accept(uid, requesterID)
+	if err != nil {
+		writeError(w, 500, "failed to accept friend request")
+		return
+	}
+	if !accepted {
+		writeError(w, 404, "no pending request from this user")
+		return
+	}
+
+	s.refreshFriendCaches(uid, requesterID)
+	s.notifyUser(requesterID, map[string]any{"type": "friendAccepted", "userId": uid})
+	writeJSON(w, 200, map[string]any{"accepted": true})
+}
+
+// DELETE /api/friends/{userId} (protected) removes a friend or a request
+func (s *Server) handleFriendRemove(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+	otherID, ok := friendTargetID(w, r, uid)
+	if !ok {
+		return
+	}
+
+	if err := s.friendStore.Remove(uid, otherID); err != nil {
+		writeError(w, 500, "failed to remove friend")
+		return
+	}
+	s.refreshFriendCaches(uid, otherID)
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// =====================
+// Games & Invites
+// =====================
+
+const (
+	defaultBoardSize = 4
+	minBoardSize     = 2
+	maxBoardSize     = 10
+
+	minSeats = 2
+	maxSeats = 4
+
+	inviteCodeLength   = 6
+	inviteCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // no 0/O or 1/I
+)
+
+// seatColors matches the frontend's red/blue for the first two seats.
+var seatColors = []string{"#e53935", "#1e88e5", "#43a047", "#fb8c00"}
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+type GameSettings struct {
+	BoardWidth  int      `json:"boardWidth"`  // boxes across
+	BoardHeight int      `json:"boardHeight"` // boxes down
+	Rated       bool     `json:"rated"`
+	Seats       int      `json:"seats"`               // players, 2-4
+	TurnOrder   []int    `json:"turnOrder,omitempty"` // seat indexes in playing order
+	Colors      []string `json:"colors,omitempty"`    // one per seat
+	Teams       []int    `json:"teams,omitempty"`     // team (0 or 1) per seat, 2v2 only
+	ExtraTurn   string   `json:"extraTurn,omitempty"` // team games: "mover" or "partner"
+	Variant     string   `json:"variant"`             // rule set, see rules.go
+	Layout      string   `json:"layout"`              // preset name or "custom", see layouts.go
+	Mask        []string `json:"mask,omitempty"`      // '#' box, '.' hole; nil for a full rectangle
+}
+
+// normalize fills in defaults and rejects settings we can't play with.
+func (gs *GameSettings) normalize() error {
+	if gs.BoardWidth == 0 {
+		gs.BoardWidth = defaultBoardSize
+	}
+	if gs.BoardHeight == 0 {
+		gs.BoardHeight = defaultBoardSize
+	}
+	if gs.BoardWidth < minBoardSize || gs.BoardWidth > maxBoardSize ||
+		gs.BoardHeight < minBoardSize || gs.BoardHeight > maxBoardSize {
+		return errors.New("board size must be between 2 and 10")
+	}
+	if err := gs.normalizeLayout(); err != nil {
+		return err
+	}
+
+	if gs.Variant == "" {
+		gs.Variant = variantStandard
+	}
+	if !validVariant(gs.Variant) {
+		return errors.New("unknown variant")
+	}
+
+	if gs.Seats == 0 {
+		gs.Seats = minSeats
+	}
+	if gs.Seats < minSeats || gs.Seats > maxSeats {
+		return errors.New("games have 2 to 4 players")
+	}
+
+	if err := gs.checkTeams(); err != nil {
+		return err
+	}
+
+	if len(gs.TurnOrder) == 0 {
+		gs.TurnOrder = gs.defaultTurnOrder()
+	}
+	if len(gs.TurnOrder) != gs.Seats {
+		return errors.New("turnOrder must list every seat once")
+	}
+	seen := make(map[int]bool)
+	for _, seat := range gs.TurnOrder {
+		if seat < 0 || seat >= gs.Seats || seen[seat] {
+			return errors.New("turnOrder must list every seat once")
+		}
+		seen[seat] = true
+	}
+	if !gs.alternatesTeams() {
+		return errors.New("teams must take turns alternately")
+	}
+
+	if len(gs.Colors) == 0 {
+		gs.Colors = append([]string(nil), seatColors[:gs.Seats]...)
+	}
+	if len(gs.Colors) != gs.Seats {
+		return errors.New("colors must have one entry per seat")
+	}
+	for _, c := range gs.Colors {
+		if !colorPattern.MatchString(c) {
+			return errors.New("colors must look like #rrggbb")
+		}
+	}
+	return nil
+}
+
+type Game struct {
+	ID         string       `json:"id"`
+	Status     string       `json:"status"` // "pending", "active", "finished"
+	Settings   GameSettings `json:"settings"`
+	PlayerIDs  []int64      `json:"playerIds"` // seat order, 0 marks an open seat
+	InviteCode string       `json:"inviteCode,omitempty"`
+	CreatedBy  int64        `json:"createdBy"`
+	CreatedAt  time.Time    `json:"createdAt"`
+}
+
+// full reports whether every seat is taken.
+func (g *Game) full() bool {
+	for _, id := range g.PlayerIDs {
+		if id == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	errInviteNotFound = errors.New("invite not found")
+	errInviteOwnGame  = errors.New("you are already in this game")
+)
+
+type GameStore struct {
+	db *sql.DB
+}
+
+func NewGameStore(db *sql.DB) *GameStore {
+	return &GameStore{db: db}
+}
+
+// CreateGame stores a game and its seats. A pending game has an invite code
+// and open seats (0 in PlayerIDs); an active one starts fully seated.
+func (s *GameStore) CreateGame(g *Game) error {
+	settings, err := json.Marshal(g.Settings)
+	if err != nil {
+		return err
+	}
+	var code sql.NullString
+	if g.InviteCode != "" {
+		code = sql.NullString{String: g.InviteCode, Valid: true}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		`INSERT INTO games (id, status, board_width, board_height, rated, settings, invite_code, created_by, started_at)
+         VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CASE WHEN $2 = 'active' THEN now() END)
+         RETURNING created_at`,
+		g.ID, g.Status, g.Settings.BoardWidth, g.Settings.BoardHeight, g.Settings.Rated,
+		settings, code, g.CreatedBy,
+	).Scan(&g.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	for seat, userID := range g.PlayerIDs {
+		var uid sql.NullInt64
+		if userID != 0 {
+			uid = sql.NullInt64{Int64: userID, Valid: true}
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO game_players (game_id, seat, user_id, color) VALUES ($1, $2, $3, $4)`,
+			g.ID, seat, uid, g.Settings.Colors[seat],
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// scanGame reads a games row selected as id, status, settings, board_width,
+// board_height, rated, invite_code, created_by, created_at.
+func scanGame(row interface{ Scan(...any) error }) (*Game, error) {
+	var g Game
+	var settings []byte
+	var code sql.NullString
+	var createdBy sql.NullInt64
+	err := row.Scan(&g.ID, &g.Status, &settings, &g.Settings.BoardWidth, &g.Settings.BoardHeight,
+		&g.Settings.Rated, &code, &createdBy, &g.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if len(settings) > 0 {
+		if err := json.Unmarshal(settings, &g.Settings); err != nil {
+			return nil, err
+		}
+	}
+	// rows from before settings were stored fall back to the defaults
+	if err := g.Settings.normalize(); err != nil {
+		return nil, err
+	}
+	g.InviteCode = code.String
+	g.CreatedBy = createdBy.Int64
+	return &g, nil
+}
+
+const gameColumns = `id, status, settings, board_width, board_height, rated, invite_code, created_by, created_at`
+
+// loadSeats fills g.PlayerIDs from game_players, 0 for open seats.
+func loadSeats(q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}, g *Game) error {
+	rows, err := q.Query(
+		`SELECT seat, user_id FROM game_players WHERE game_id = $1 ORDER BY seat ASC`,
+		g.ID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	g.PlayerIDs = make([]int64, g.Settings.Seats)
+	for rows.Next() {
+		var seat int
+		var userID sql.NullInt64
+		if err := rows.Scan(&seat, &userID); err != nil {
+			return err
+		}
+		if seat >= 0 && seat < len(g.PlayerIDs) {
+			g.PlayerIDs[seat] = userID.Int64
+		}
+	}
+	return rows.Err()
+}
+
+// JoinByCode seats userID in the first open seat of the pending game with
+// that invite code. The game starts once the last seat is filled.
+func (s *GameStore) JoinByCode(code string, userID int64) (*Game, int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	g, err := scanGame(tx.QueryRow(
+		`SELECT `+gameColumns+`
+           FROM games
+          WHERE invite_code = $1 AND status = 'pending'
+          FOR UPDATE`,
+		code,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, errInviteNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := loadSeats(tx, g); err != nil {
+		return nil, 0, err
+	}
+
+	seat := -1
+	for i, id := range g.PlayerIDs {
+		if id == userID {
+			return nil, 0, errInviteOwnGame
+		}
+		if id == 0 && seat == -1 {
+			seat = i
+		}
+	}
+	if seat == -1 {
+		return nil, 0, errInviteNotFound
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE game_players SET user_id = $3 WHERE game_id = $1 AND seat = $2`,
+		g.ID, seat, userID,
+	); err != nil {
+		return nil, 0, err
+	}
+	g.PlayerIDs[seat] = userID
+
+	if g.full() {
+		if _, err := tx.Exec(
+			`UPDATE games SET status = 'active', started_at = now() WHERE id = $1`,
+			g.ID,
+		); err != nil {
+			return nil, 0, err
+		}
+		g.Status = "active"
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	return g, seat, nil
+}
+
+// GetGame loads a game by ID, or returns sql.ErrNoRows.
+func (s *GameStore) GetGame(gameID string) (*Game, error) {
+	g, err := scanGame(s.db.QueryRow(`SELECT `+gameColumns+` FROM games WHERE id = $1`, gameID))
+	if err != nil {
+		return nil, err
+	}
+	if err := loadSeats(s.db, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// PendingPlayers returns who is already seated in the pending game with
+// this code.
+func (s *GameStore) PendingPlayers(code string) ([]int64, error) {
+	rows, err := s.db.Query(
+		`SELECT p.user_id
+           FROM games g
+           JOIN game_players p ON p.game_id = g.id
+          WHERE g.invite_code = $1 AND g.status = 'pending' AND p.user_id IS NOT NULL`,
+		code,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, errInviteNotFound
+	}
+	return ids, nil
+}
+
+func newInviteCode() string {
+	b := make([]byte, inviteCodeLength)
+	rand.Read(b)
+	for i := range b {
+		b[i] = inviteCodeAlphabet[int(b[i])%len(inviteCodeAlphabet)]
+	}
+	return string(b)
+}
+
+// appLink builds a URL into the frontend when PUBLIC_APP_URL is configured,
+// and a path the frontend can resolve otherwise.
+func appLink(path string) string {
+	return strings.TrimRight(os.Getenv("PUBLIC_APP_URL"), "/") + path
+}
+
+func inviteLink(code string) string {
+	return appLink("/join/" + code)
+}
+
+// POST /api/games (protected) creates a private game to share by invite code
+func (s *Server) handleCreateGame(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+
+	// An empty body means "default settings"
+	var settings GameSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, 400, "invalid JSON")
+		return
+	}
+	if err := settings.normalize(); err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	if err := settings.checkConnected(); err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	if settings.Rated && !s.mayPlayRated(uid) {
+		writeError(w, 403, errVerifiedRequired.Error())
+		return
+	}
+
+	// Creator takes the first seat, the rest wait for invitees
+	g := &Game{
+		ID:        uuid.NewString(),
+		Status:    "pending",
+		Settings:  settings,
+		PlayerIDs: make([]int64, settings.Seats),
+		CreatedBy: uid,
+	}
+	g.PlayerIDs[0] = uid
+
+	// Codes are short, so retry the rare collision with a live invite
+	var err error
+	for range 5 {
+		g.InviteCode = newInviteCode()
+		if err = s.gameStore.CreateGame(g); err == nil || !strings.Contains(err.Error(), "duplicate key") {
+			break
+		}
+	}
+	if err != nil {
+		log.Println("CreateGame error:", err)
+		writeError(w, 500, "failed to create game")
+		return
+	}
+
+	gameRegistry.Register(g.ID, g.PlayerIDs)
+
+	writeJSON(w, 200, map[string]any{
+		"game":       g,
+		"inviteCode": g.InviteCode,
+		"inviteLink": inviteLink(g.InviteCode),
+	})
+}
+
+type joinGameReq struct {
+	Code string `json:"code"`
+}
+
+// POST /api/games/join (protected) takes the open seat of an invite game
+func (s *Server) handleJoinGame(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+
+	var req joinGameReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, 400, "invalid JSON")
+		return
+	}
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+	if code == "" {
+		writeError(w, 400, "missing code")
+		return
+	}
+
+	if requireVerifiedEmail {
+		if rated, err := s.gameStore.RatedInvite(code); err == nil && rated && !s.mayPlayRated(uid) {
+			writeError(w, 403, errVerifiedRequired.Error())
+			return
+		}
+	}
+
+	seated, err := s.gameStore.PendingPlayers(code)
+	for _, id := range seated {
+		blocked, berr := s.blockStore.EitherBlocked(uid, id)
+		if berr != nil {
+			log.Println("EitherBlocked error:", berr)
+			writeError(w, 500, "failed to join game")
+			return
+		}
+		deleted, derr := s.userStore.Deleted(id)
+		if derr != nil {
+			log.Println("Deleted error:", derr)
+			writeError(w, 500, "failed to join game")
+			return
+		}
+		if blocked || deleted {
+			writeError(w, 403, "can't join this game")
+			return
+		}
+	}
+
+	var g *Game
+	var seat int
+	if err == nil {
+		g, seat, err = s.gameStore.JoinByCode(code, uid)
+	}
+	switch {
+	case errors.Is(err, errInviteNotFound):
+		writeError(w, 404, err.Error())
+		return
+	case errors.Is(err, errInviteOwnGame):
+		writeError(w, 400, err.Error())
+		return
+	case err != nil:
+		log.Println("JoinByCode error:", err)
+		writeError(w, 500, "failed to join game")
+		return
+	}
+
+	if !gameRegistry.ClaimSeat(g.ID, seat, uid) {
+		// e.g. after a restart the registry forgot the pending game
+		gameRegistry.Register(g.ID, g.PlayerIDs)
+	}
+
+	// Everybody else is usually waiting in the lobby; send them into the game
+	// once the last seat is taken.
+	if g.Status == "active" {
+		start := LobbyStartGame{Type: "startGame", GameID: g.ID, PlayerIDs: g.PlayerIDs, Settings: &g.Settings}
+		for _, id := range g.PlayerIDs {
+			if id != uid {
+				s.notifyUser(id, start)
+			}
+		}
+	}
+
+	writeJSON(w, 200, map[string]any{
+		"game":        g,
+		"playerIndex": seat,
+		"started":     g.Status == "active",
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// =====================
+// Board Layouts
+// =====================
+
+// A layout is a mask over the board's boxes: one string per box row, '#'
+// for a playable box and '.' for a hole. Edges that only border holes don't
+// exist. Named presets are generated for the chosen board size.
+
+const (
+	layoutRectangle = "rectangle"
+	layoutCross     = "cross"
+	layoutDonut     = "donut"
+	layoutL         = "lShape"
+	layoutCustom    = "custom"
+
+	maskBox  = '#'
+	maskHole = '.'
+)
+
+var layoutPresets = []string{layoutRectangle, layoutCross, layoutDonut, layoutL}
+
+// presetMask builds a named layout for a w x h board, or nil for a plain
+// rectangle.
+func presetMask(name string, w, h int) ([]string, error) {
+	hole := func(row, col int) bool { return false }
+
+	switch name {
+	case "", layoutRectangle:
+		return nil, nil
+	case layoutCross:
+		if w < 3 || h < 3 {
+			return nil, errors.New("cross needs a board of at least 3x3")
+		}
+		cw, ch := max(w/3, 1), max(h/3, 1)
+		hole = func(row, col int) bool {
+			return (row < ch || row >= h-ch) && (col < cw || col >= w-cw)
+		}
+	case layoutDonut:
+		if w < 3 || h < 3 {
+			return nil, errors.New("donut needs a board of at least 3x3")
+		}
+		rw, rh := max(w/3, 1), max(h/3, 1)
+		hole = func(row, col int) bool {
+			return row >= rh && row < h-rh && col >= rw && col < w-rw
+		}
+	case layoutL:
+		hole = func(row, col int) bool { return row < h/2 && col >= w-w/2 }
+	default:
+		return nil, errors.New("unknown layout")
+	}
+
+	mask := make([]string, h)
+	for row := range h {
+		var b strings.Builder
+		for col := range w {
+			if hole(row, col) {
+				b.WriteByte(maskHole)
+			} else {
+				b.WriteByte(maskBox)
+			}
+		}
+		mask[row] = b.String()
+	}
+	return mask, nil
+}
+
+// normalizeLayout fills Mask from a preset, or checks a custom mask.
+func (gs *GameSettings) normalizeLayout() error {
+	if gs.Layout == "" && gs.Mask != nil {
+		gs.Layout = layoutCustom
+	}
+	if gs.Layout != layoutCustom {
+		mask, err := presetMask(gs.Layout, gs.BoardWidth, gs.BoardHeight)
+		if err != nil {
+			return err
+		}
+		if gs.Layout == "" {
+			gs.Layout = layoutRectangle
+		}
+		gs.Mask = mask
+		return nil
+	}
+
+	if len(gs.Mask) != gs.BoardHeight {
+		return errors.New("mask must have one row per box row")
+	}
+	boxes := 0
+	for _, row := range gs.Mask {
+		if len(row) != gs.BoardWidth {
+			return errors.New("mask rows must have one character per box column")
+		}
+		for _, ch := range row {
+			switch ch {
+			case maskBox:
+				boxes++
+			case maskHole:
+			default:
+				return errors.New("mask may only contain '#' and '.'")
+			}
+		}
+	}
+	if boxes == 0 {
+		return errors.New("layout has no playable boxes")
+	}
+	return nil
+}
+
+// checkConnected refuses a custom layout with a box cut off from the rest:
+// it has only outline edges, which Swedish rules pre-draw without anyone
+// scoring the box, so the game could never end. Only new games are
+// checked; stored ones still load.
+func (gs *GameSettings) checkConnected() error {
+	if gs.Mask == nil {
+		return nil
+	}
+	boxes := 0
+	for _, row := range gs.Mask {
+		boxes += strings.Count(row, string(maskBox))
+	}
+	if boxes < 2 {
+		return errors.New("layout needs at least two playable boxes")
+	}
+	if floodBoxes(gs.Mask) != boxes {
+		return errors.New("playable boxes must all be connected side to side")
+	}
+	return nil
+}
+
+// floodBoxes counts the boxes reachable from the first one through shared
+// sides.
+func floodBoxes(mask []string) int {
+	type cell struct{ row, col int }
+	seen := map[cell]bool{}
+	var stack []cell
+	for row, line := range mask {
+		if col := strings.IndexByte(line, maskBox); col >= 0 {
+			stack = append(stack, cell{row, col})
+			seen[cell{row, col}] = true
+			break
+		}
+	}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, n := range []cell{{c.row - 1, c.col}, {c.row + 1, c.col}, {c.row, c.col - 1}, {c.row, c.col + 1}} {
+			if n.row < 0 || n.row >= len(mask) || n.col < 0 || n.col >= len(mask[n.row]) {
+				continue
+			}
+			if mask[n.row][n.col] == maskBox && !seen[n] {
+				seen[n] = true
+				stack = append(stack, n)
+			}
+		}
+	}
+	return len(seen)
+}
+
+// boxEnabled reports whether the box at (row, col) is on the board.
+func (gs *GameSettings) boxEnabled(row, col int) bool {
+	if row < 0 || row >= gs.BoardHeight || col < 0 || col >= gs.BoardWidth {
+		return false
+	}
+	return gs.Mask == nil || gs.Mask[row][col] == maskBox
+}
+
+// allEdges lists every edge of the layout.
+func (st *GameState) allEdges() []edgeRef {
+	w, h := st.Settings.BoardWidth, st.Settings.BoardHeight
+	var edges []edgeRef
+	for row := 0; row <= h; row++ {
+		for col := range w {
+			if e := (edgeRef{'h', row, col}); st.validEdge(e) {
+				edges = append(edges, e)
+			}
+		}
+	}
+	for row := range h {
+		for col := 0; col <= w; col++ {
+			if e := (edgeRef{'v', row, col}); st.validEdge(e) {
+				edges = append(edges, e)
+			}
+		}
+	}
+	return edges
+}
+
+// GET /api/layouts?width=&height= lists the presets for a board size
+func (s *Server) handleListLayouts(w http.ResponseWriter, r *http.Request) {
+	width, _ := strconv.Atoi(r.URL.Query().Get("width"))
+	height, _ := strconv.Atoi(r.URL.Query().Get("height"))
+	if width == 0 {
+		width = defaultBoardSize
+	}
+	if height == 0 {
+		height = defaultBoardSize
+	}
+	if width < minBoardSize || width > maxBoardSize || height < minBoardSize || height > maxBoardSize {
+		writeError(w, 400, "board size must be between 2 and 10")
+		return
+	}
+
+	type layout struct {
+		Name string   `json:"name"`
+		Mask []string `json:"mask"`
+	}
+	layouts := []layout{}
+	for _, name := range layoutPresets {
+		mask, err := presetMask(name, width, height)
+		if err != nil {
+			continue
+		}
+		if mask == nil {
+			mask = make([]string, height)
+			for i := range mask {
+				mask[i] = strings.Repeat(string(maskBox), width)
+			}
+		}
+		layouts = append(layouts, layout{Name: name, Mask: mask})
+	}
+	writeJSON(w, 200, map[string]any{"layouts": layouts})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPresetMask(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  string
+		w, h    int
+		want    []string
+		wantErr bool
+	}{
+		{name: "rectangle", layout: layoutRectangle, w: 3, h: 3},
+		{name: "default", layout: "", w: 3, h: 3},
+		{name: "cross", layout: layoutCross, w: 3, h: 3, want: []string{".#.", "###", ".#."}},
+		{name: "donut", layout: layoutDonut, w: 3, h: 3, want: []string{"###", "#.#", "###"}},
+		{name: "L", layout: layoutL, w: 4, h: 4, want: []string{"##..", "##..", "####", "####"}},
+		{name: "cross too small", layout: layoutCross, w: 2, h: 2, wantErr: true},
+		{name: "donut too small", layout: layoutDonut, w: 3, h: 2, wantErr: true},
+		{name: "unknown", layout: "spiral", w: 3, h: 3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mask, err := presetMask(tt.layout, tt.w, tt.h)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(mask, tt.want) {
+				t.Errorf("mask = %q, want %q", mask, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeCustomLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		mask    []string
+		wantErr bool
+	}{
+		{"valid", []string{"#.", "##"}, false},
+		{"too few rows", []string{"##"}, true},
+		{"row too short", []string{"##", "#"}, true},
+		{"bad character", []string{"#x", "##"}, true},
+		{"no boxes", []string{"..", ".."}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := GameSettings{BoardWidth: 2, BoardHeight: 2, Mask: tt.mask}
+			err := gs.normalizeLayout()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && gs.Layout != layoutCustom {
+				t.Errorf("Layout = %q, want %q", gs.Layout, layoutCustom)
+			}
+		})
+	}
+}
+
+func TestCheckConnected(t *testing.T) {
+	tests := []struct {
+		name    string
+		mask    []string
+		wantErr bool
+	}{
+		{"rectangle", nil, false},
+		{"boxes in a row", []string{"..", "##"}, false},
+		{"L of three", []string{"#.", "##"}, false},
+		{"single box", []string{"#.", ".."}, true},
+		{"boxes touching at a corner", []string{"#.", ".#"}, true},
+	}
+
+	for _, tt := range tests {
+		gs := GameSettings{BoardWidth: 2, BoardHeight: 2, Mask: tt.mask}
+		if err := gs.checkConnected(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLayoutEdges(t *testing.T) {
+	tests := []struct {
+		layout    string
+		wantEdges int
+		wantBoxes int
+	}{
+		{layoutRectangle, 24, 9},
+		{layoutCross, 16, 5},
+		{layoutDonut, 24, 8},
+	}
+
+	for _, tt := range tests {
+		st := newTestState(t, GameSettings{BoardWidth: 3, BoardHeight: 3, Layout: tt.layout})
+		if got := len(st.allEdges()); got != tt.wantEdges {
+			t.Errorf("%s: %d edges, want %d", tt.layout, got, tt.wantEdges)
+		}
+		if got := st.totalBoxes(); got != tt.wantBoxes {
+			t.Errorf("%s: %d boxes, want %d", tt.layout, got, tt.wantBoxes)
+		}
+	}
+}
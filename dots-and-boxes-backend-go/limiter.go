@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// =====================
+// Brute-force Limiter & Lockout
+// =====================
+
+// Failed attempts are counted per key ("ip:1.2.3.4", "user:alice"). After
+// a few free failures each further attempt has to wait twice as long as
+// the last; enough failures on one account lock it for a while. Account
+// locks are also stored in users.locked_until so they survive a restart
+// and an admin can lift them. They don't stop the right password coming
+// from an IP the account has logged in from before and that has a clean
+// record, so a stranger can't lock anyone out.
+
+type limitPolicy struct {
+	free        int           // failures before backoff starts
+	base        time.Duration // first backoff delay
+	max         time.Duration // longest backoff delay
+	lockAfter   int           // failures before a lockout, 0 = never
+	lockFor     time.Duration
+	forgetAfter time.Duration // a quiet key starts over
+}
+
+var (
+	loginUserPolicy = limitPolicy{free: 3, base: time.Second, max: 5 * time.Minute, lockAfter: 10, lockFor: 15 * time.Minute, forgetAfter: time.Hour}
+	loginIPPolicy   = limitPolicy{free: 10, base: time.Second, max: 5 * time.Minute, forgetAfter: time.Hour}
+	registerPolicy  = limitPolicy{free: 5, base: 5 * time.Second, max: 10 * time.Minute, forgetAfter: time.Hour}
+	resetPolicy     = limitPolicy{free: 3, base: time.Minute, max: time.Hour, forgetAfter: 6 * time.Hour}
+	emailPolicy     = limitPolicy{free: 3, base: time.Minute, max: time.Hour, forgetAfter: 6 * time.Hour}
+)
+
+type attemptEntry struct {
+	failures    int
+	last        time.Time
+	next        time.Time // no attempts before this
+	lockedUntil time.Time
+}
+
+type attemptLimiter struct {
+	mu      sync.Mutex
+	policy  limitPolicy
+	entries map[string]*attemptEntry
+}
+
+func newAttemptLimiter(p limitPolicy) *attemptLimiter {
+	return &attemptLimiter{policy: p, entries: make(map[string]*attemptEntry)}
+}
+
+// Allow reports whether key may try now, and if not how long to wait.
+func (l *attemptLimiter) Allow(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		return 0, true
+	}
+	now := time.Now()
+	if now.Before(e.lockedUntil) {
+		return e.lockedUntil.Sub(now), false
+	}
+	if now.Before(e.next) {
+		return e.next.Sub(now), false
+	}
+	return 0, true
+}
+
+// Fail records a failed attempt and reports whether it locked the key.
+func (l *attemptLimiter) Fail(key string) (locked bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	e, ok := l.entries[key]
+	if !ok || now.Sub(e.last) > l.policy.forgetAfter {
+		e = &attemptEntry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.last = now
+
+	if over := e.failures - l.policy.free; over > 0 {
+		delay := time.Duration(float64(l.policy.base) * math.Pow(2, float64(over-1)))
+		e.next = now.Add(min(delay, l.policy.max))
+	}
+	if l.policy.lockAfter > 0 && e.failures >= l.policy.lockAfter {
+		e.lockedUntil = now.Add(l.policy.lockFor)
+		e.failures = 0
+		return true
+	}
+	return false
+}
+
+// Clean reports whether key has no failures on record.
+func (l *attemptLimiter) Clean(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		return true
+	}
+	now := time.Now()
+	return now.Sub(e.last) > l.policy.forgetAfter && now.After(e.lockedUntil)
+}
+
+func (l *attemptLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// prune drops keys that have been quiet long enough to start over.
+func (l *attemptLimiter) prune(now time.Time) {
+	for key, e := range l.entries {
+		if now.Sub(e.last) > l.policy.forgetAfter && now.After(e.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// limited answers 429 with Retry-After when any key has to wait.
+func limited(w http.ResponseWriter, l *attemptLimiter, keys ...string) bool {
+	for _, key := range keys {
+		if wait, ok := l.Allow(key); !ok {
+			retryLater(w, wait)
+			return true
+		}
+	}
+	return false
+}
+
+func retryLater(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, "too many attempts, try again later")
+}
+
+// dummyPasswordHash is compared against when a login names no user, so
+// the answer takes as long as for a real one.
+var dummyPasswordHash = func() string {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+	return string(hash)
+}()
+
+func userLimitKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func ipLimitKey(ip string) string {
+	return "ip:" + ip
+}
+
+// =====================
+// Audit Log
+// =====================
+
+// audit records a security event. It never fails the request it belongs to.
+func audit(db *sql.DB, event string, userID int64, ip, detail string) {
+	if db == nil {
+		return
+	}
+	var uid sql.NullInt64
+	if userID != 0 {
+		uid = sql.NullInt64{Int64: userID, Valid: true}
+	}
+	if _, err := db.Exec(
+		`INSERT INTO audit_log (event, user_id, ip, detail) VALUES ($1, $2, $3, $4)`,
+		event, uid, ip, detail,
+	); err != nil {
+		log.Println("audit error:", err)
+	}
+}
+
+// LockedUntil returns when the account's lockout ends; zero if unlocked.
+func (s *UserStore) LockedUntil(userID int64) (time.Time, error) {
+	var until sql.NullTime
+	err := s.db.QueryRow(`SELECT locked_until FROM users WHERE id = $1`, userID).Scan(&until)
+	if err != nil || !until.Valid || time.Now().After(until.Time) {
+		return time.Time{}, err
+	}
+	return until.Time, nil
+}
+
+func (s *UserStore) Lock(userID int64, until time.Time) error {
+	_, err := s.db.Exec(`UPDATE users SET locked_until = $2 WHERE id = $1`, userID, until)
+	return err
+}
+
+// Unlock lifts a lockout and returns the username, or sql.ErrNoRows.
+func (s *UserStore) Unlock(userID int64) (string, error) {
+	var username string
+	err := s.db.QueryRow(
+		`UPDATE users SET locked_until = NULL WHERE id = $1 RETURNING username`,
+		userID,
+	).Scan(&username)
+	return username, err
+}
+
+func (s *UserStore) IsAdmin(userID int64) (bool, error) {
+	var admin bool
+	err := s.db.QueryRow(`SELECT is_admin FROM users WHERE id = $1`, userID).Scan(&admin)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return admin, err
+}
+
+// loginFailed counts a failed login for ip and username and locks the
+// account once the username key trips its limit.
+func (s *Server) loginFailed(r *http.Request, username string, userID int64) {
+	ip := getIP(r)
+	s.loginIPLimiter.Fail(ipLimitKey(ip))
+	if !s.loginUserLimiter.Fail(userLimitKey(username)) || userID == 0 {
+		return
+	}
+
+	until := time.Now().Add(loginUserPolicy.lockFor)
+	if err := s.userStore.Lock(userID, until); err != nil {
+		log.Println("Lock error:", err)
+	}
+	audit(s.db, "account_locked", userID, ip, "too many failed logins for "+username)
+}
+
+// trustedLoginIP reports whether the right password from ip may skip the
+// account's backoff and lock: the account has had a session from ip and
+// the IP has no recent failures.
+func (s *Server) trustedLoginIP(userID int64, ip string) bool {
+	if !s.loginIPLimiter.Clean(ipLimitKey(ip)) {
+		return false
+	}
+	known, err := s.sessionStore.KnownIP(userID, ip)
+	if err != nil {
+		log.Println("KnownIP error:", err)
+	}
+	return known
+}
+
+// adminMiddleware only lets users with users.is_admin through.
+func (s *Server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return s.authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		uid := r.Context().Value("userId").(int64)
+		admin, err := s.userStore.IsAdmin(uid)
+		if err != nil {
+			log.Println("IsAdmin error:", err)
+		}
+		if !admin {
+			writeError(w, 403, "admins only")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), "adminId", uid)))
+	})
+}
+
+// POST /api/admin/users/{userId}/unlock (admin) lifts a login lockout
+func (s *Server) handleAdminUnlock(w http.ResponseWriter, r *http.Request) {
+	adminID := r.Context().Value("adminId").(int64)
+	userID, err := strconv.ParseInt(r.PathValue("userId"), 10, 64)
+	if err != nil {
+		writeError(w, 400, "invalid user id")
+		return
+	}
+
+	username, err := s.userStore.Unlock(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, 404, "user not found")
+		return
+	}
+	if err != nil {
+		log.Println("Unlock error:", err)
+		writeError(w, 500, "failed to unlock account")
+		return
+	}
+	s.loginUserLimiter.Reset(userLimitKey(username))
+
+	audit(s.db, "account_unlocked", userID, getIP(r), "unlocked by admin "+strconv.FormatInt(adminID, 10))
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
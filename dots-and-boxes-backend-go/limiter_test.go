@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAttemptLimiterBackoff(t *testing.T) {
+	l := newAttemptLimiter(limitPolicy{free: 2, base: time.Second, max: 4 * time.Second, forgetAfter: time.Hour})
+
+	// wait expected after each failure: free ones, then doubling up to max
+	tests := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i, want := range tests {
+		if locked := l.Fail("ip:1.2.3.4"); locked {
+			t.Fatalf("failure %d locked a policy without lockouts", i+1)
+		}
+		wait, ok := l.Allow("ip:1.2.3.4")
+		if want == 0 {
+			if !ok {
+				t.Errorf("failure %d: blocked for %v, want free", i+1, wait)
+			}
+			continue
+		}
+		if ok || wait > want || wait < want-100*time.Millisecond {
+			t.Errorf("failure %d: Allow = %v, %v; want about %v", i+1, wait, ok, want)
+		}
+	}
+
+	if _, ok := l.Allow("ip:5.6.7.8"); !ok {
+		t.Error("an unrelated key was blocked")
+	}
+	if l.Clean("ip:1.2.3.4") || !l.Clean("ip:5.6.7.8") {
+		t.Error("Clean should only report keys without failures")
+	}
+	l.Reset("ip:1.2.3.4")
+	if _, ok := l.Allow("ip:1.2.3.4"); !ok {
+		t.Error("Reset key still blocked")
+	}
+}
+
+func TestAttemptLimiterLockout(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     limitPolicy
+		failures   int
+		wantLocked bool
+	}{
+		{"below the limit", limitPolicy{free: 10, lockAfter: 3, lockFor: time.Minute, forgetAfter: time.Hour}, 2, false},
+		{"at the limit", limitPolicy{free: 10, lockAfter: 3, lockFor: time.Minute, forgetAfter: time.Hour}, 3, true},
+		{"never locks", limitPolicy{free: 10, forgetAfter: time.Hour}, 20, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newAttemptLimiter(tt.policy)
+			locked := false
+			for range tt.failures {
+				locked = l.Fail("user:alice")
+			}
+			if locked != tt.wantLocked {
+				t.Fatalf("locked = %v, want %v", locked, tt.wantLocked)
+			}
+			wait, ok := l.Allow("user:alice")
+			if tt.wantLocked && (ok || wait < tt.policy.lockFor-time.Second) {
+				t.Errorf("Allow = %v, %v; want locked for about %v", wait, ok, tt.policy.lockFor)
+			}
+			if !tt.wantLocked && !ok {
+				t.Errorf("blocked for %v without a lockout", wait)
+			}
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	useTestKeys(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("right password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lockedUntil driver.Value
+	knownIPs := map[string]bool{}
+	db := newFakeDB(t, func(query string, args []any) (*fakeRows, error) {
+		switch {
+		case strings.Contains(query, "password_hash, rating"):
+			if strings.EqualFold(args[0].(string), "alice") {
+				return oneRow(int64(7), "alice", "Alice", string(hash), int64(1200), time.Now(), "", ""), nil
+			}
+		case strings.Contains(query, "SELECT locked_until"):
+			return oneRow(lockedUntil), nil
+		case strings.Contains(query, "SET locked_until"):
+			lockedUntil = args[1]
+		case strings.Contains(query, "FROM sessions WHERE user_id = $1 AND ip = $2"):
+			return oneRow(knownIPs[args[1].(string)]), nil
+		case strings.Contains(query, "INSERT INTO sessions"):
+			knownIPs[args[3].(string)] = true
+		}
+		return nil, nil
+	})
+	s := NewServer(db)
+
+	login := func(ip, password string) int {
+		body := `{"username":"alice","password":"` + password + `"}`
+		r := httptest.NewRequest("POST", "/auth/login", strings.NewReader(body))
+		r.RemoteAddr = ip + ":40000"
+		w := httptest.NewRecorder()
+		s.handleLogin(w, r)
+		return w.Code
+	}
+
+	if code := login("10.0.0.1", "right password"); code != 200 {
+		t.Fatalf("owner's first login = %d, want 200", code)
+	}
+	for range loginUserPolicy.lockAfter {
+		login("10.0.0.66", "guess")
+	}
+	if lockedUntil == nil {
+		t.Fatal("account not locked after the attacker's failures")
+	}
+
+	tests := []struct {
+		name     string
+		ip       string
+		password string
+		want     int
+	}{
+		{"wrong guess from a fresh IP", "10.0.0.77", "guess", 429},
+		{"right guess from the same IP", "10.0.0.77", "right password", 429},
+		{"right guess from another fresh IP", "10.0.0.88", "right password", 429},
+		{"owner from a known IP", "10.0.0.1", "right password", 200},
+	}
+	for _, tt := range tests {
+		if code := login(tt.ip, tt.password); code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.want)
+		}
+	}
+}
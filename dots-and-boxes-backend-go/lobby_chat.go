@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// =====================
+// Lobby Chat History
+// =====================
+
+const (
+	lobbyChatJoinHistory = 50  // messages replayed to a new lobby client
+	lobbyChatMaxPage     = 100 // upper bound for ?limit= on the history API
+)
+
+// saveLobbyChat stores a message sent to a lobby room and returns its id
+// and timestamp.
+func saveLobbyChat(db *sql.DB, room string, userID int64, displayName, text string) (int64, time.Time, error) {
+	if db == nil {
+		return 0, time.Now().UTC(), nil
+	}
+	var id int64
+	var createdAt time.Time
+	err := db.QueryRow(
+		`INSERT INTO chat_messages (user_id, display_name, message, room_type, room)
+         VALUES ($1, $2, $3, 'lobby', $4)
+         RETURNING id, created_at`,
+		userID, displayName, text, room,
+	).Scan(&id, &createdAt)
+	if err != nil {
+		// the message still goes out, stamped now
+		return 0, time.Now().UTC(), err
+	}
+	return id, createdAt, nil
+}
+
+// loadLobbyChat returns up to limit messages from a lobby room older than
+// the message with id before (or the newest ones when before is 0), oldest
+// first. Messages from users viewerID blocked or muted are left out, as in
+// live delivery.
+func loadLobbyChat(db *sql.DB, viewerID int64, room string, before int64, limit int) ([]LobbyMessage, error) {
+	if db == nil {
+		return nil, nil
+	}
+
+	rows, err := db.Query(
+		`SELECT id, user_id, display_name, message, created_at
+           FROM chat_messages
+          WHERE room_type = 'lobby' AND room = $1 AND ($2 = 0 OR id < $2)
+            AND NOT EXISTS (SELECT 1 FROM user_blocks b
+                             WHERE b.user_id = $4 AND b.target_id = chat_messages.user_id)
+          ORDER BY id DESC
+          LIMIT $3`,
+		room, before, limit, viewerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []LobbyMessage
+	for rows.Next() {
+		m := LobbyMessage{Type: "chat", Room: room}
+		if err := rows.Scan(&m.ID, &m.UserID, &m.DisplayName, &m.Text, &m.SentAt); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// newest-first from the query; clients want to render oldest-first
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, nil
+}
+
+// GET /api/lobby/chat?room=<name>&before=<messageId>&limit=<n> (protected)
+func (s *Server) handleLobbyChatHistory(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+
+	room := defaultLobbyRoom
+	if v := r.URL.Query().Get("room"); v != "" {
+		room = normalizeRoomName(v)
+	}
+	if ok, err := s.roomStore.CanJoin(room, uid); err != nil || !ok {
+		writeError(w, 404, "room not found")
+		return
+	}
+
+	var before int64
+	if v := r.URL.Query().Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, 400, "invalid before")
+			return
+		}
+		before = n
+	}
+
+	limit := lobbyChatJoinHistory
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, 400, "invalid limit")
+			return
+		}
+		limit = min(n, lobbyChatMaxPage)
+	}
+
+	msgs, err := loadLobbyChat(s.db, uid, room, before, limit)
+	if err != nil {
+		writeError(w, 500, "failed to load chat")
+		return
+	}
+
+	// nextBefore is the cursor for the next (older) page; 0 means no more.
+	var nextBefore int64
+	if len(msgs) == limit {
+		nextBefore = msgs[0].ID
+	}
+	if msgs == nil {
+		msgs = []LobbyMessage{}
+	}
+	writeJSON(w, 200, map[string]any{
+		"messages":   msgs,
+		"nextBefore": nextBefore,
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// =====================
+// Mailer
+// =====================
+
+// Mailer delivers account email (password resets, verification links).
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// newMailerFromEnv picks SMTP when SMTP_HOST is set; otherwise mail is
+// written to MAIL_LOG_FILE, or to the server log.
+func newMailerFromEnv() Mailer {
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		from := os.Getenv("MAIL_FROM")
+		if from == "" {
+			from = "no-reply@localhost"
+		}
+		return &smtpMailer{
+			addr:     net.JoinHostPort(host, port),
+			host:     host,
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+			from:     from,
+		}
+	}
+	return &logMailer{path: os.Getenv("MAIL_LOG_FILE")}
+}
+
+// logMailer is for local development: nothing leaves the machine.
+type logMailer struct {
+	mu   sync.Mutex
+	path string // "" logs to the server log
+}
+
+func (m *logMailer) Send(to, subject, body string) error {
+	entry := fmt.Sprintf("--- %s\nTo: %s\nSubject: %s\n\n%s\n", time.Now().UTC().Format(time.RFC3339), to, subject, body)
+	if m.path == "" {
+		log.Print("mail:\n" + entry)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(entry)
+	return err
+}
+
+type smtpMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	// header injection guard: addresses and subjects are single lines
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid mail header")
+	}
+
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	msg := "From: " + m.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(m.addr, auth, m.from, []string{to}, []byte(msg))
+}
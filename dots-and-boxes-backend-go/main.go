@@ -9,11 +9,11 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	jwt "github.com/golang-jwt/jwt/v5"
@@ -24,66 +24,13 @@ import (
 // Config / Secrets
 // =====================
 
-var jwtSecret = []byte("SUPER_SECRET_KEY_CHANGE_ME") // TODO: move to ENV for real deployment
+// JWT signing keys are loaded at startup, see jwt_keys.go
 
 // =====================
 // Registration Token
 // =====================
 
-type RegistrationToken struct {
-	Token     string
-	IP        string
-	UserAgent string
-	ExpiresAt time.Time
-}
-
-type TokenStore struct {
-	mu     sync.Mutex
-	tokens map[string]RegistrationToken
-}
-
-func NewTokenStore() *TokenStore {
-	return &TokenStore{
-		tokens: make(map[string]RegistrationToken),
-	}
-}
-
-func (s *TokenStore) CreateRegistrationToken(ip, ua string, ttl time.Duration) RegistrationToken {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	t := RegistrationToken{
-		Token:     uuid.NewString(),
-		IP:        ip,
-		UserAgent: ua,
-		ExpiresAt: time.Now().UTC().Add(ttl),
-	}
-	s.tokens[t.Token] = t
-	return t
-}
-
-func (s *TokenStore) ValidateAndConsume(tokenStr, ip, ua string) (RegistrationToken, bool, string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	token, ok := s.tokens[tokenStr]
-	if !ok {
-		return RegistrationToken{}, false, "token not found"
-	}
-	if time.Now().UTC().After(token.ExpiresAt) {
-		delete(s.tokens, tokenStr)
-		return RegistrationToken{}, false, "token expired"
-	}
-	if token.IP != ip {
-		return RegistrationToken{}, false, "IP mismatch"
-	}
-	if token.UserAgent != ua {
-		return RegistrationToken{}, false, "User-Agent mismatch"
-	}
-
-	delete(s.tokens, tokenStr)
-	return token, true, ""
-}
+// Registration tokens live in a pluggable store, see registration_tokens.go
 
 // =====================
 // User & UserStore
@@ -93,7 +40,10 @@ type User struct {
 	ID          int64     `json:"id"`
 	Username    string    `json:"username"`
 	DisplayName string    `json:"displayName"`
+	Rating      int       `json:"rating"`
 	CreatedAt   time.Time `json:"createdAt"`
+	Country     string    `json:"country,omitempty"`
+	AvatarURL   string    `json:"avatarUrl,omitempty"`
 }
 
 type UserStore struct {
@@ -104,21 +54,24 @@ func NewUserStore(db *sql.DB) *UserStore {
 	return &UserStore{db: db}
 }
 
-// CreateUser inserts a new user with bcrypt password hash.
-func (s *UserStore) CreateUser(username, displayName, password string) (*User, error) {
+// CreateUser inserts a new user with bcrypt password hash. email may be
+// empty; it stays unverified until the user follows the mailed link.
+func (s *UserStore) CreateUser(username, displayName, password, email string) (*User, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, err
 	}
 
 	query := `
-		INSERT INTO users (username, password_hash, display_name)
-		VALUES ($1, $2, $3)
-		RETURNING id, created_at
+		INSERT INTO users (username, password_hash, display_name, email, username_skeleton, display_skeleton)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6)
+		RETURNING id, rating, created_at
 	`
 
 	var u User
-	err = s.db.QueryRow(query, username, string(hash), displayName).Scan(&u.ID, &u.CreatedAt)
+	err = s.db.QueryRow(
+		query, username, string(hash), displayName, email, confusableSkeleton(username), confusableSkeleton(displayName),
+	).Scan(&u.ID, &u.Rating, &u.CreatedAt)
 	if err != nil {
 		if strings.Contains(err.Error(), "duplicate key") || strings.Contains(err.Error(), "unique") {
 			return nil, errors.New("username already taken")
@@ -137,17 +90,15 @@ func (s *UserStore) GetUserByUsername(username string) (*User, string, error) {
 	var hash string
 
 	query := `
-		SELECT id, display_name, password_hash, created_at
+		SELECT id, username, display_name, password_hash, rating, created_at, country, COALESCE(avatar_url, '')
 		FROM users
-		WHERE username = $1
+		WHERE lower(username) = lower($1)
 	`
 
-	err := s.db.QueryRow(query, username).Scan(&u.ID, &u.DisplayName, &hash, &u.CreatedAt)
+	err := s.db.QueryRow(query, username).Scan(&u.ID, &u.Username, &u.DisplayName, &hash, &u.Rating, &u.CreatedAt, &u.Country, &u.AvatarURL)
 	if err != nil {
 		return nil, "", err
 	}
-
-	u.Username = username
 	return &u, hash, nil
 }
 
@@ -155,12 +106,12 @@ func (s *UserStore) GetUserByUsername(username string) (*User, string, error) {
 func (s *UserStore) GetUserByID(id int64) (*User, error) {
 	var u User
 	query := `
-		SELECT username, display_name, created_at
+		SELECT username, display_name, rating, created_at, country, COALESCE(avatar_url, '')
 		FROM users
 		WHERE id = $1
 	`
 	u.ID = id
-	err := s.db.QueryRow(query, id).Scan(&u.Username, &u.DisplayName, &u.CreatedAt)
+	err := s.db.QueryRow(query, id).Scan(&u.Username, &u.DisplayName, &u.Rating, &u.CreatedAt, &u.Country, &u.AvatarURL)
 	if err != nil {
 		return nil, err
 	}
@@ -171,26 +122,40 @@ func (s *UserStore) GetUserByID(id int64) (*User, error) {
 // JWT Helpers
 // =====================
 
-func generateJWT(userID int64) (string, error) {
+// generateJWT issues a short-lived access token for one login session.
+func generateJWT(userID int64, sessionID string) (string, error) {
 	claims := jwt.MapClaims{
 		"userId": userID,
-		"exp":    time.Now().UTC().Add(24 * time.Hour).Unix(), // 1 day
+		"sid":    sessionID,
+		"exp":    time.Now().UTC().Add(accessTokenTTL).Unix(),
 		"iat":    time.Now().UTC().Unix(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return jwtKeys.sign(claims)
 }
 
 func parseJWT(tokenStr string) (int64, error) {
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (any, error) {
-		return jwtSecret, nil
-	})
+	userID, _, err := parseAccessToken(tokenStr)
+	return userID, err
+}
+
+// parseAccessToken validates an access token and returns its user and
+// session. Tokens of revoked sessions are rejected.
+func parseAccessToken(tokenStr string) (int64, string, error) {
+	token, err := jwt.Parse(tokenStr, jwtKeys.keyFunc, jwt.WithValidMethods(jwtKeys.methods()))
 	if err != nil || !token.Valid {
-		return 0, errors.New("invalid token")
+		return 0, "", errors.New("invalid token")
 	}
 
 	claims := token.Claims.(jwt.MapClaims)
-	return int64(claims["userId"].(float64)), nil
+	userID, ok := claims["userId"].(float64)
+	sessionID, _ := claims["sid"].(string)
+	if !ok || sessionID == "" {
+		return 0, "", errors.New("invalid token")
+	}
+	if revokedSessions.has(sessionID) {
+		return 0, "", errSessionRevoked
+	}
+	return int64(userID), sessionID, nil
 }
 
 // =====================
@@ -199,55 +164,100 @@ func parseJWT(tokenStr string) (int64, error) {
 
 type LobbyMessage struct {
 	Type        string    `json:"type"`        // "chat"
+	ID          int64     `json:"id,omitempty"`
+	Room        string    `json:"room,omitempty"`
 	UserID      int64     `json:"userId"`
 	DisplayName string    `json:"displayName"`
 	Text        string    `json:"text"`
 	SentAt      time.Time `json:"sentAt"`
 }
 
-type LobbyUser struct {
-	UserID      int64  `json:"userId"`
-	DisplayName string `json:"displayName"`
-}
-
-type LobbyPresence struct {
-	Type  string      `json:"type"`  // "presence"
-	Users []LobbyUser `json:"users"`
-}
-
-
 type LobbyClient struct {
 	hub  *LobbyHub
 	conn *websocket.Conn
 	send chan []byte
 	user *User
+	db   *sql.DB
+
+	session  string // login session, see revokeSession
+
+	roomMu sync.Mutex
+	room   string // current lobby room, see Room()
+
+	// owned by the hub goroutine
+	lastActive time.Time
+	seeking    bool
+	ignored    map[int64]bool // blocked or muted users whose chat is hidden
+	friends    map[int64]bool
 }
 
 type LobbyHub struct {
 	clients    map[*LobbyClient]bool
-	broadcast  chan []byte
+	broadcast  chan lobbyOutbound
 	register   chan *LobbyClient
 	unregister chan *LobbyClient
+	touch      chan *LobbyClient
+	status     chan lobbyStatusChange
+	games      chan lobbyGameActivity
+	rooms      chan lobbyRoomChange
+	roomLists  chan lobbyRoomList
+	ignores    chan lobbyIgnoreUpdate
+
+	friendUpdates chan lobbyFriendsUpdate
+	onlineQueries chan lobbyOnlineQuery
+	gameOvers     chan lobbyGameOver
+	kicks         chan string // session IDs whose sockets must close
+	profiles      chan lobbyProfile
+
+	presence map[string]map[int64]LobbyUser // room -> last state sent to clients
+	inGame   map[int64]map[string]int       // userID -> gameID -> open game sockets
+	edited   map[int64]lobbyProfile         // profile edits newer than the clients' *User
+	ratings  map[int64]int                  // ratings changed by games since the clients' *User
+}
+
+// lobbyOutbound is a message for everybody in Room ("" means every room),
+// for the single client To, or for every connection of UserIDs. When
+// TargetUserID is set the message is only delivered if that user is in the
+// room; otherwise Sender gets an error back. FromUserID marks chat and
+// challenges that clients ignoring that user must not receive.
+type lobbyOutbound struct {
+	Room         string
+	Data         []byte
+	To           *LobbyClient
+	UserIDs      []int64
+	Sender       *LobbyClient
+	TargetUserID int64
+	FromUserID   int64
 }
 
 type LobbyInbound struct {
-	Type           string `json:"type"`          // "chat", "challenge", "challengeAccept"
+	Type           string `json:"type"`          // "chat", "dm", "challenge", "challengeAccept", "challengeDecline", "status", "joinRoom", "leaveRoom", "listRooms", "createRoom", "roomInvite"
 	Text           string `json:"text"`          // for chat
-	TargetUserID   int64  `json:"targetUserId"`  // for challenge
-	OpponentUserID int64  `json:"opponentUserId"`// for challengeAccept
+	Status         string `json:"status"`        // for status: "available" or "seeking"
+	Room           string `json:"room"`          // for joinRoom, leaveRoom, createRoom, roomInvite
+	Private        bool   `json:"private"`       // for createRoom
+	TargetUserID   int64  `json:"targetUserId"`  // for challenge, dm, roomInvite
+	TargetUserIDs  []int64       `json:"targetUserIds"` // for group challenge
+	ChallengeID    string        `json:"challengeId"`   // for challengeAccept/challengeDecline
+	Settings       *GameSettings `json:"settings"`      // for challenge
 }
 
 type LobbyChallengeOffer struct {
-	Type         string `json:"type"`         // "challengeOffer"
-	FromUserID   int64  `json:"fromUserId"`
-	FromName     string `json:"fromName"`
-	TargetUserID int64  `json:"targetUserId"`
+	Type          string        `json:"type"` // "challengeOffer"
+	Room          string        `json:"room"`
+	ChallengeID   string        `json:"challengeId"`
+	FromUserID    int64         `json:"fromUserId"`
+	FromName      string        `json:"fromName"`
+	TargetUserID  int64         `json:"targetUserId,omitempty"`
+	TargetUserIDs []int64       `json:"targetUserIds,omitempty"`
+	Settings      *GameSettings `json:"settings,omitempty"`
 }
 
 type LobbyStartGame struct {
-	Type      string  `json:"type"`
-	GameID    string  `json:"gameId"`
-	PlayerIDs []int64 `json:"playerIds"` // two players
+	Type      string        `json:"type"`
+	GameID    string        `json:"gameId"`
+	PlayerIDs []int64       `json:"playerIds"` // in seat order
+	Settings  *GameSettings `json:"settings,omitempty"`
 }
 
 
@@ -255,87 +265,135 @@ type LobbyStartGame struct {
 func NewLobbyHub() *LobbyHub {
 	return &LobbyHub{
 		clients:    make(map[*LobbyClient]bool),
-		broadcast:  make(chan []byte),
+		broadcast:  make(chan lobbyOutbound),
 		register:   make(chan *LobbyClient),
 		unregister: make(chan *LobbyClient),
+		touch:      make(chan *LobbyClient, 64),
+		status:     make(chan lobbyStatusChange),
+		games:      make(chan lobbyGameActivity, 64),
+		rooms:      make(chan lobbyRoomChange),
+		roomLists:  make(chan lobbyRoomList),
+		ignores:    make(chan lobbyIgnoreUpdate),
+
+		friendUpdates: make(chan lobbyFriendsUpdate),
+		onlineQueries: make(chan lobbyOnlineQuery),
+		gameOvers:     make(chan lobbyGameOver, 16),
+		kicks:         make(chan string),
+		profiles:      make(chan lobbyProfile),
+
+		presence:   make(map[string]map[int64]LobbyUser),
+		inGame:     make(map[int64]map[string]int),
+		edited:     make(map[int64]lobbyProfile),
+		ratings:    make(map[int64]int),
 	}
 }
 
 func (h *LobbyHub) Run() {
+	ticker := time.NewTicker(lobbyAwayCheckInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case client := <-h.register:
+			wasOnline := h.isOnline(client.user.ID)
+			client.lastActive = time.Now()
 			h.clients[client] = true
-			h.broadcastPresence()
+			h.refreshPresence(client.user.ID)
+			h.sendSnapshot(client)
+			if !wasOnline {
+				h.announceOnline(client)
+			}
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.send)
-				h.broadcastPresence()
+				h.refreshPresence(client.user.ID)
+				if !h.isOnline(client.user.ID) {
+					delete(h.edited, client.user.ID)
+					delete(h.ratings, client.user.ID)
+				}
 			}
-		case msg := <-h.broadcast:
+		case client := <-h.touch:
+			if h.clients[client] {
+				client.lastActive = time.Now()
+				h.refreshPresence(client.user.ID)
+			}
+		case change := <-h.status:
+			if h.clients[change.client] {
+				change.client.lastActive = time.Now()
+				change.client.seeking = change.seeking
+				h.refreshPresence(change.client.user.ID)
+			}
+		case act := <-h.games:
+			h.applyGameActivity(act)
+		case change := <-h.rooms:
+			h.applyRoomChange(change)
+		case list := <-h.roomLists:
+			h.sendRoomList(list)
+		case u := <-h.ignores:
+			h.applyIgnoreUpdate(u)
+		case u := <-h.friendUpdates:
+			h.applyFriendsUpdate(u)
+		case q := <-h.onlineQueries:
+			h.answerOnlineQuery(q)
+		case g := <-h.gameOvers:
+			h.announceGameOver(g)
+		case p := <-h.profiles:
+			h.applyProfile(p)
+		case sessionID := <-h.kicks:
+			// readPump notices the closed socket and unregisters
 			for c := range h.clients {
-				select {
-				case c.send <- msg:
-				default:
-					delete(h.clients, c)
-					close(c.send)
+				if c.session == sessionID {
+					c.conn.Close()
+				}
+			}
+		case <-ticker.C:
+			h.refreshAll()
+		case msg := <-h.broadcast:
+			if msg.To != nil {
+				h.sendTo(msg.To, msg.Data)
+				continue
+			}
+			if len(msg.UserIDs) > 0 {
+				h.deliverToUsers(msg.UserIDs, msg.Data)
+				continue
+			}
+			if msg.TargetUserID != 0 {
+				if _, ok := h.presence[msg.Room][msg.TargetUserID]; !ok {
+					h.sendError(msg.Sender, "that player is not in this room")
+					continue
 				}
 			}
+			h.deliver(msg.Room, msg.Data, msg.FromUserID)
 		}
 	}
 }
 
-func (h *LobbyHub) currentUsers() []LobbyUser {
-	seen := make(map[int64]bool)
-	var users []LobbyUser
-
+// deliver sends msg to every lobby client in room ("" for all rooms),
+// skipping clients that ignore fromUserID, dropping clients whose buffers
+// are full and announcing them as gone.
+func (h *LobbyHub) deliver(room string, msg []byte, fromUserID int64) {
+	dropped := make(map[int64]bool)
 	for c := range h.clients {
-		if c.user == nil {
+		if room != "" && c.Room() != room {
 			continue
 		}
-		if seen[c.user.ID] {
+		if fromUserID != 0 && c.ignored[fromUserID] {
 			continue
 		}
-		seen[c.user.ID] = true
-
-		displayName := c.user.DisplayName
-		if displayName == "" {
-			displayName = c.user.Username
-		}
-
-		users = append(users, LobbyUser{
-			UserID:      c.user.ID,
-			DisplayName: displayName,
-		})
-	}
-	return users
-}
-
-func (h *LobbyHub) broadcastPresence() {
-	users := h.currentUsers()
-	p := LobbyPresence{
-		Type:  "presence",
-		Users: users,
-	}
-	data, err := json.Marshal(p)
-	if err != nil {
-		log.Println("presence marshal error:", err)
-		return
-	}
-
-	for c := range h.clients {
 		select {
-		case c.send <- data:
+		case c.send <- msg:
 		default:
 			delete(h.clients, c)
 			close(c.send)
+			dropped[c.user.ID] = true
 		}
 	}
+	for userID := range dropped {
+		h.refreshPresence(userID)
+	}
 }
 
-
-
 func (c *LobbyClient) readPump() {
 	defer func() {
 		c.hub.unregister <- c
@@ -357,50 +415,93 @@ func (c *LobbyClient) readPump() {
 		}
 
 		switch payload.Type {
+		case "status":
+			switch payload.Status {
+			case "available":
+				c.hub.status <- lobbyStatusChange{client: c, seeking: false}
+			case "seeking":
+				c.hub.status <- lobbyStatusChange{client: c, seeking: true}
+			}
+			continue
+		}
+
+		// any other message counts as activity for away detection
+		c.hub.touch <- c
+
+		switch payload.Type {
+		case "joinRoom", "leaveRoom", "listRooms", "createRoom", "roomInvite":
+			c.handleRoomMessage(payload)
+
+		case "dm":
+			c.handleDirectMessage(payload)
+
 		case "challenge":
-			if payload.TargetUserID == 0 {
+			if !c.mayChallenge() {
+				continue
+			}
+			if len(payload.TargetUserIDs) > 0 {
+				c.handleGroupChallenge(payload)
+				continue
+			}
+			if payload.TargetUserID == 0 || payload.TargetUserID == c.user.ID {
+				continue
+			}
+			if c.unreachable(payload.TargetUserID) {
+				c.sendError("you can't challenge this player")
+				continue
+			}
+
+			settings, err := challengeSettings(payload.Settings, 2)
+			if err != nil {
+				c.sendError(err.Error())
 				continue
 			}
 
+			// The offer is kept here, so accepting only names its ID
+			gc := groupChallenges.open(c.user.ID, []int64{payload.TargetUserID}, settings)
+
 			fromName := c.user.DisplayName
 			if fromName == "" {
 				fromName = c.user.Username
 			}
 
+			room := c.Room()
 			offer := LobbyChallengeOffer{
 				Type:         "challengeOffer",
+				Room:         room,
+				ChallengeID:  gc.ID,
 				FromUserID:   c.user.ID,
 				FromName:     fromName,
 				TargetUserID: payload.TargetUserID,
+				Settings:     &gc.Settings,
 			}
 
 			out, err := json.Marshal(offer)
 			if err != nil {
 				continue
 			}
-			c.hub.broadcast <- out
 
-		case "challengeAccept":
-			if payload.OpponentUserID == 0 {
+			// Friends can challenge each other from any room
+			if c.isFriend(payload.TargetUserID) {
+				c.hub.broadcast <- lobbyOutbound{Data: out, UserIDs: gc.participants()}
 				continue
 			}
-
-			// Create a temporary gameId (later we store in DB)
-			gameID := uuid.NewString()
-
-			gameRegistry.Register(gameID, c.user.ID, payload.OpponentUserID)
-
-			start := LobbyStartGame{
-				Type:      "startGame",
-				GameID:    gameID,
-				PlayerIDs: []int64{c.user.ID, payload.OpponentUserID},
+			c.hub.broadcast <- lobbyOutbound{
+				Room:         room,
+				Data:         out,
+				Sender:       c,
+				TargetUserID: payload.TargetUserID,
+				FromUserID:   c.user.ID,
 			}
 
-			out, err := json.Marshal(start)
-			if err != nil {
+		case "challengeAccept", "challengeDecline":
+			if payload.Type == "challengeAccept" && !c.mayChallenge() {
 				continue
 			}
-			c.hub.broadcast <- out
+			if payload.ChallengeID == "" {
+				continue
+			}
+			c.handleChallengeAnswer(payload)
 
 		default:
 			// Treat as chat (fallback)
@@ -409,19 +510,27 @@ func (c *LobbyClient) readPump() {
 				continue
 			}
 
+			room := c.Room()
+			id, sentAt, err := saveLobbyChat(c.db, room, c.user.ID, c.user.DisplayName, txt)
+			if err != nil {
+				log.Println("saveLobbyChat error:", err)
+			}
+
 			chat := LobbyMessage{
 				Type:        "chat",
+				ID:          id,
+				Room:        room,
 				UserID:      c.user.ID,
 				DisplayName: c.user.DisplayName,
 				Text:        txt,
-				SentAt:      time.Now().UTC(),
+				SentAt:      sentAt,
 			}
 
 			out, err := json.Marshal(chat)
 			if err != nil {
 				continue
 			}
-			c.hub.broadcast <- out
+			c.hub.broadcast <- lobbyOutbound{Room: room, Data: out, FromUserID: c.user.ID}
 		}
 	}
 }
@@ -459,6 +568,8 @@ type GameClient struct {
 	userID int64
 	gameID string
 	db     *sql.DB   
+
+	session string // login session, see revokeSession
 }
 
 
@@ -471,6 +582,17 @@ type GameMove struct {
     PlayerSlot string `json:"playerSlot,omitempty"` // "p1" or "p2"
 	DisplayName string    `json:"displayName,omitempty"`
 	SentAt     time.Time `json:"sentAt,omitempty"`
+	NewGameID  string    `json:"newGameId,omitempty"` // for rematchStart
+	PlayerIDs  []int64   `json:"playerIds,omitempty"` // for rematchStart
+	Scope      string         `json:"scope,omitempty"`  // takebackRequest: "move" or "turn"; chat: "team"
+	Turn       string         `json:"turn,omitempty"`   // slot to move next
+	Moves      []StoredMove   `json:"moves,omitempty"`  // for state
+	Scores     map[string]int `json:"scores,omitempty"` // for state and gameOver
+	Results    []GameResult   `json:"results,omitempty"` // for gameOver
+	TeamScores []int          `json:"teamScores,omitempty"` // team games, for state and gameOver
+	InitialEdges []string     `json:"initialEdges,omitempty"` // for state: edges the variant pre-draws
+
+	to []int64 // recipients; nil means everyone in the game
 }
 
 
@@ -480,23 +602,39 @@ type GameHub struct {
 	register   chan *GameClient
 	unregister chan *GameClient
 	broadcast  chan GameMove
+
+	replies    chan gameReply
+	kicks      chan string // session IDs whose sockets must close
+
+	lobby     *LobbyHub // told when players open/close game sockets, may be nil
+	rematches *rematchOffers
+	states    *gameStates
+}
+
+// gameReply is a message for one game client only, such as an error.
+type gameReply struct {
+	client *GameClient
+	move   GameMove
 }
 
 type StoredMove struct {
-	EdgeID     string
-	PlayerSlot string
+	ID         int64  `json:"id,omitempty"`
+	EdgeID     string `json:"edgeId"`
+	PlayerSlot string `json:"playerSlot"`
 }
 
-func saveMove(db *sql.DB, gameID string, userID int64, edgeID, slot string) error {
+func saveMove(db *sql.DB, gameID string, userID int64, edgeID, slot string) (int64, error) {
 	if db == nil {
-		return nil
+		return 0, nil
 	}
-	_, err := db.Exec(
+	var id int64
+	err := db.QueryRow(
 		`INSERT INTO moves (game_id, user_id, edge_id, player_slot)
-         VALUES ($1, $2, $3, $4)`,
+         VALUES ($1, $2, $3, $4)
+         RETURNING id`,
 		gameID, userID, edgeID, slot,
-	)
-	return err
+	).Scan(&id)
+	return id, err
 }
 
 func loadMoves(db *sql.DB, gameID string) ([]StoredMove, error) {
@@ -504,9 +642,9 @@ func loadMoves(db *sql.DB, gameID string) ([]StoredMove, error) {
 		return nil, nil
 	}
 	rows, err := db.Query(
-		`SELECT edge_id, player_slot
+		`SELECT id, edge_id, player_slot
          FROM moves
-         WHERE game_id = $1
+         WHERE game_id = $1 AND retracted_at IS NULL
          ORDER BY id ASC`,
 		gameID,
 	)
@@ -518,7 +656,7 @@ func loadMoves(db *sql.DB, gameID string) ([]StoredMove, error) {
 	var moves []StoredMove
 	for rows.Next() {
 		var m StoredMove
-		if err := rows.Scan(&m.EdgeID, &m.PlayerSlot); err != nil {
+		if err := rows.Scan(&m.ID, &m.EdgeID, &m.PlayerSlot); err != nil {
 			return nil, err
 		}
 		moves = append(moves, m)
@@ -540,17 +678,19 @@ func saveGameChat(db *sql.DB, gameID string, userID int64, displayName, text str
 	return err
 }
 
-func loadGameChat(db *sql.DB, gameID string) ([]GameMove, error) {
+// loadGameChat returns the game's chat plus team's private messages
+// (team -1 for spectators and non-team games).
+func loadGameChat(db *sql.DB, gameID string, team int) ([]GameMove, error) {
     if db == nil {
         return nil, nil
     }
 
     rows, err := db.Query(
-        `SELECT user_id, message, created_at
+        `SELECT user_id, message, created_at, room_type
            FROM chat_messages
-          WHERE game_id = $1 AND room_type = 'game'
+          WHERE game_id = $1 AND (room_type = 'game' OR (room_type = 'team' AND team = $2))
           ORDER BY created_at ASC, id ASC`,
-        gameID,
+        gameID, team,
     )
     if err != nil {
         return nil, err
@@ -562,15 +702,21 @@ func loadGameChat(db *sql.DB, gameID string) ([]GameMove, error) {
         var userID int64
         var msgText string
         var createdAt time.Time
-        if err := rows.Scan(&userID, &msgText, &createdAt); err != nil {
+        var roomType string
+        if err := rows.Scan(&userID, &msgText, &createdAt, &roomType); err != nil {
             return nil, err
         }
+        scope := ""
+        if roomType == "team" {
+            scope = "team"
+        }
         msgs = append(msgs, GameMove{
             Type:   "chat",
             GameID: gameID,
             UserID: userID,
             Text:   msgText,
             SentAt: createdAt,
+            Scope:  scope,
         })
     }
     return msgs, rows.Err()
@@ -586,6 +732,10 @@ func NewGameHub() *GameHub {
 		register:   make(chan *GameClient),
 		unregister: make(chan *GameClient),
 		broadcast:  make(chan GameMove),
+		replies:    make(chan gameReply),
+		kicks:      make(chan string),
+		rematches:  newRematchOffers(),
+		states:     newGameStates(),
 	}
 }
 
@@ -597,14 +747,17 @@ func (h *GameHub) Run() {
 				h.games[client.gameID] = make(map[*GameClient]bool)
 			}
 			h.games[client.gameID][client] = true
+			h.notifyLobby(client, true)
 
 		case client := <-h.unregister:
 			if room, ok := h.games[client.gameID]; ok {
 				if _, exists := room[client]; exists {
 					delete(room, client)
 					close(client.send)
+					h.notifyLobby(client, false)
 					if len(room) == 0 {
 						delete(h.games, client.gameID)
+						h.states.forget(client.gameID)
 					}
 				}
 			}
@@ -616,18 +769,51 @@ func (h *GameHub) Run() {
 					continue
 				}
 				for c := range room {
+					if move.to != nil && !slices.Contains(move.to, c.userID) {
+						continue
+					}
 					select {
 					case c.send <- data:
 					default:
 						delete(room, c)
 						close(c.send)
+						h.notifyLobby(c, false)
+					}
+				}
+			}
+
+		case sessionID := <-h.kicks:
+			// readPump notices the closed socket and unregisters
+			for _, room := range h.games {
+				for c := range room {
+					if c.session == sessionID {
+						c.conn.Close()
 					}
 				}
 			}
+
+		case r := <-h.replies:
+			if room, ok := h.games[r.client.gameID]; ok && room[r.client] {
+				data, err := json.Marshal(r.move)
+				if err != nil {
+					continue
+				}
+				select {
+				case r.client.send <- data:
+				default:
+				}
+			}
 		}
 	}
 }
 
+func (h *GameHub) notifyLobby(c *GameClient, joined bool) {
+	if h.lobby == nil {
+		return
+	}
+	h.lobby.games <- lobbyGameActivity{UserID: c.userID, GameID: c.gameID, Joined: joined}
+}
+
 //  from browser
 type GameInbound struct {
 	Type   string `json:"type"`   
@@ -659,25 +845,62 @@ func (c *GameClient) readPump() {
 				continue
 			}
 
-			// Frontend will send "p1" or "p2"
-			slot := incoming.PlayerSlot
-			if slot != "p1" && slot != "p2" {
+			var move *GameMove
+			var moveErr error
+			var final []int // seat scores once the last box is taken
+			var settings GameSettings
+			var players []int64
+			c.hub.states.with(c.db, c.gameID, func(st *GameState) {
+				// Seat comes from the game record; the client's slot is only
+				// trusted where nobody is seated (the demo board).
+				slot := st.SlotFor(c.userID)
+				if slot == "" && !st.seated() {
+					slot = incoming.PlayerSlot
+				}
+				if slot == "" {
+					moveErr = errNotYourTurn
+					return
+				}
+
+				// 1) Validate against the server's board
+				pending := st.takeback
+				if _, moveErr = st.Apply(incoming.EdgeID, slot); moveErr != nil {
+					return
+				}
+
+				// 2) Persist move in DB; a move that isn't stored didn't happen
+				id, err := saveMove(c.db, c.gameID, c.userID, incoming.EdgeID, slot)
+				if err != nil {
+					log.Println("saveMove error:", err)
+					st.undoLast()
+					st.takeback = pending
+					moveErr = errors.New("failed to save move, try again")
+					return
+				}
+				st.Moves[len(st.Moves)-1].ID = id
+
+				move = &GameMove{
+					Type:       "move",
+					GameID:     c.gameID,
+					EdgeID:     incoming.EdgeID,
+					PlayerSlot: slot,
+					Turn:       st.Turn,
+				}
+				if st.Over() {
+					final, settings, players = st.SeatScores(), st.Settings, st.PlayerIDs
+				}
+			})
+			if moveErr != nil {
+				c.hub.replies <- gameReply{client: c, move: GameMove{Type: "error", GameID: c.gameID, Text: moveErr.Error()}}
 				continue
 			}
 
-			// 1) Persist move in DB
-			if err := saveMove(c.db, c.gameID, c.userID, incoming.EdgeID, slot); err != nil {
-				log.Println("saveMove error:", err)
-			}
+			// 3) Broadcast canonical move to all clients
+			c.hub.broadcast <- *move
 
-			// 2) Broadcast canonical move to all clients
-			move := GameMove{
-				Type:       "move",
-				GameID:     c.gameID,
-				EdgeID:     incoming.EdgeID,
-				PlayerSlot: slot,
+			if final != nil {
+				c.finishGame(settings, players, final, -1)
 			}
-			c.hub.broadcast <- move
 
 		case "chat":
 			txt := strings.TrimSpace(incoming.Text)
@@ -691,12 +914,6 @@ func (c *GameClient) readPump() {
 				displayName = "Player"
 			}
 
-			// Save chat to DB
-			if err := saveGameChat(c.db, c.gameID, c.userID, displayName, txt); err != nil {
-				log.Println("saveGameChat error:", err)
-			}
-
-			// Broadcast chat to both players
 			out := GameMove{
 				Type:        "chat",
 				GameID:      c.gameID,
@@ -705,20 +922,81 @@ func (c *GameClient) readPump() {
 				DisplayName: displayName,
 				SentAt:      time.Now().UTC(),
 			}
+
+			// Team chat only reaches the sender's teammates
+			if incoming.Scope == "team" {
+				team := -1
+				c.hub.states.with(c.db, c.gameID, func(st *GameState) {
+					team = st.TeamOf(c.userID)
+					out.to = st.Teammates(team)
+				})
+				if team < 0 {
+					c.hub.replies <- gameReply{client: c, move: GameMove{Type: "error", GameID: c.gameID, Text: "team chat is only for team games"}}
+					continue
+				}
+				out.Scope = "team"
+				if err := saveTeamChat(c.db, c.gameID, team, c.userID, displayName, txt); err != nil {
+					log.Println("saveTeamChat error:", err)
+				}
+				c.hub.broadcast <- out
+				continue
+			}
+
+			// Save chat to DB
+			if err := saveGameChat(c.db, c.gameID, c.userID, displayName, txt); err != nil {
+				log.Println("saveGameChat error:", err)
+			}
+
+			// Broadcast chat to all players
 			c.hub.broadcast <- out
 
 		case "endGame":
+			// Only a seated player can end the game, and it counts as their
+			// resignation
+			var final []int
+			var settings GameSettings
+			var players []int64
+			resigned := -1
+			var errText string
+			c.hub.states.with(c.db, c.gameID, func(st *GameState) {
+				slot := st.SlotFor(c.userID)
+				switch {
+				case slot == "":
+					errText = "only players can end the game"
+				case st.Over():
+					errText = errGameOver.Error()
+				default:
+					st.resigned = true
+					st.takeback = nil
+					resigned = slotSeat(slot)
+					final, settings, players = st.SeatScores(), st.Settings, st.PlayerIDs
+				}
+			})
+			if errText != "" {
+				c.hub.replies <- gameReply{client: c, move: GameMove{Type: "error", GameID: c.gameID, Text: errText}}
+				continue
+			}
+
 			txt := strings.TrimSpace(incoming.Text)
 			if txt == "" {
 				txt = "Game ended by a player"
 			}
 
 			out := GameMove{
-				Type:   "endGame",
-				GameID: c.gameID,
-				Text:   txt,
+				Type:       "endGame",
+				GameID:     c.gameID,
+				Text:       txt,
+				PlayerSlot: seatSlot(resigned),
 			}
 			c.hub.broadcast <- out
+
+			c.finishGame(settings, players, final, resigned)
+
+		case "rematch", "rematchAccept", "rematchDecline":
+			c.handleRematch(incoming.Type)
+
+		case "takebackRequest", "takebackAccept", "takebackDecline":
+			c.handleTakeback(incoming.Type, incoming.Scope)
 		}
 	}
 }
@@ -741,7 +1019,7 @@ func (c *GameClient) writePump() {
 
 type GameRegistry struct {
 	mu    sync.RWMutex
-	games map[string][]int64 // exactly two players per game
+	games map[string][]int64 // seat order, 0 while a seat is open
 }
 
 func NewGameRegistry() *GameRegistry {
@@ -750,10 +1028,31 @@ func NewGameRegistry() *GameRegistry {
 	}
 }
 
-func (gr *GameRegistry) Register(gameID string, p1, p2 int64) {
+func (gr *GameRegistry) Register(gameID string, playerIDs []int64) {
+	gr.mu.Lock()
+	defer gr.mu.Unlock()
+	gr.games[gameID] = append([]int64(nil), playerIDs...)
+}
+
+// ClaimSeat puts userID in an open seat. It returns false if the game is
+// unknown or that seat is taken.
+func (gr *GameRegistry) ClaimSeat(gameID string, seat int, userID int64) bool {
 	gr.mu.Lock()
 	defer gr.mu.Unlock()
-	gr.games[gameID] = []int64{p1, p2}
+
+	players, ok := gr.games[gameID]
+	if !ok || seat < 0 || seat >= len(players) || players[seat] != 0 {
+		return false
+	}
+	players[seat] = userID
+	return true
+}
+
+// Players returns the user IDs seated in the game, or nil if it's unknown.
+func (gr *GameRegistry) Players(gameID string) []int64 {
+	gr.mu.RLock()
+	defer gr.mu.RUnlock()
+	return append([]int64(nil), gr.games[gameID]...)
 }
 
 func (gr *GameRegistry) IsPlayerInGame(gameID string, userID int64) bool {
@@ -789,18 +1088,53 @@ type Server struct {
 	db         *sql.DB
 	tokenStore *TokenStore
 	userStore  *UserStore
-	lobbyHub   *LobbyHub
+	roomStore  *RoomStore
+	blockStore  *BlockStore
+	friendStore *FriendStore
+	refreshStore *RefreshStore
+	sessionStore *SessionStore
+	resetStore   *ResetStore
+	statsStore   *StatsStore
+
+	loginUserLimiter *attemptLimiter
+	loginIPLimiter   *attemptLimiter
+	registerLimiter  *attemptLimiter
+	resetLimiter     *attemptLimiter
+	emailLimiter     *attemptLimiter
+
+	mailer       Mailer
+	blobs        BlobStore
+	gameStore   *GameStore
+	lobbyHub    *LobbyHub
 	gameHub    *GameHub   
 }
 
 func NewServer(db *sql.DB) *Server {
 	s := &Server{
 		db:         db,
-		tokenStore: NewTokenStore(),
+		tokenStore: NewTokenStore(newTokenBackendFromEnv(db)),
 		userStore:  NewUserStore(db),
+		roomStore:  NewRoomStore(db),
+		blockStore:  NewBlockStore(db),
+		friendStore: NewFriendStore(db),
+		refreshStore: NewRefreshStore(db),
+		sessionStore: NewSessionStore(db),
+		resetStore:   NewResetStore(db),
+		statsStore:   NewStatsStore(db),
+
+		loginUserLimiter: newAttemptLimiter(loginUserPolicy),
+		loginIPLimiter:   newAttemptLimiter(loginIPPolicy),
+		registerLimiter:  newAttemptLimiter(registerPolicy),
+		resetLimiter:     newAttemptLimiter(resetPolicy),
+		emailLimiter:     newAttemptLimiter(emailPolicy),
+
+		mailer:       newMailerFromEnv(),
+		blobs:        newBlobStoreFromEnv(),
+		gameStore:   NewGameStore(db),
 		lobbyHub:   NewLobbyHub(),
 		gameHub:    NewGameHub(), 
 	}
+	s.gameHub.lobby = s.lobbyHub
 	go s.gameHub.Run() // 👈 VERY IMPORTANT
 
     return s
@@ -847,7 +1181,27 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 // POST /auth/register-token
 func (s *Server) handleRegisterToken(w http.ResponseWriter, r *http.Request) {
-	t := s.tokenStore.CreateRegistrationToken(getIP(r), getUA(r), 10*time.Minute)
+	// Every token counts against the IP, so scripts can't farm accounts
+	ipKey := ipLimitKey(getIP(r))
+	if limited(w, s.registerLimiter, ipKey) {
+		return
+	}
+	s.registerLimiter.Fail(ipKey)
+
+	if !checkRegisterPow(w, r) {
+		return
+	}
+
+	t, err := s.tokenStore.CreateRegistrationToken(getIP(r), getUA(r), 10*time.Minute)
+	if errors.Is(err, errTooManyTokens) {
+		writeError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("CreateRegistrationToken error:", err)
+		writeError(w, 500, "failed to create token")
+		return
+	}
 	writeJSON(w, 200, map[string]any{
 		"token":     t.Token,
 		"expiresAt": t.ExpiresAt.Format(time.RFC3339),
@@ -859,6 +1213,7 @@ type registerReq struct {
 	Username    string `json:"username"`
 	DisplayName string `json:"displayName"`
 	Password    string `json:"password"`
+	Email       string `json:"email"` // optional, verified by a mailed link
 }
 
 // POST /auth/register
@@ -874,13 +1229,37 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Validate before the token is consumed so a typo doesn't cost a new one
+	errs := validationRules.Username(req.Username)
+	displayName, nameErrs := validationRules.DisplayName(req.DisplayName)
+	errs = append(errs, nameErrs...)
+	errs = append(errs, validationRules.Password(req.Password, req.Username)...)
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email != "" && !strings.Contains(req.Email, "@") {
+		errs.add("email", "invalid", "must be an email address")
+	}
+	if len(errs) == 0 {
+		errs = s.checkLookalikeName(displayName, 0)
+	}
+	if len(errs) > 0 {
+		writeValidation(w, errs)
+		return
+	}
+	req.DisplayName = displayName
+
+	ipKey := ipLimitKey(getIP(r))
+	if limited(w, s.registerLimiter, ipKey) {
+		return
+	}
+
 	_, ok, msg := s.tokenStore.ValidateAndConsume(req.Token, getIP(r), getUA(r))
 	if !ok {
+		s.registerLimiter.Fail(ipKey)
 		writeError(w, 400, "invalid token: "+msg)
 		return
 	}
 
-	u, err := s.userStore.CreateUser(req.Username, req.DisplayName, req.Password)
+	u, err := s.userStore.CreateUser(req.Username, req.DisplayName, req.Password, req.Email)
 	if err != nil {
 		if err.Error() == "username already taken" {
 			writeError(w, 409, err.Error())
@@ -890,12 +1269,22 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, 200, map[string]any{"user": u})
+	verificationSent := false
+	if req.Email != "" {
+		if err := s.sendVerification(u.ID, req.Email); err != nil {
+			log.Println("sendVerification error:", err)
+		} else {
+			verificationSent = true
+		}
+	}
+
+	writeJSON(w, 200, map[string]any{"user": u, "verificationSent": verificationSent})
 }
 
 type loginReq struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Device   string `json:"device"` // optional name shown in the sessions list
 }
 
 // POST /auth/login
@@ -906,22 +1295,80 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ipKey, userKey := ipLimitKey(getIP(r)), userLimitKey(req.Username)
+	if limited(w, s.loginIPLimiter, ipKey) {
+		return
+	}
+
 	u, hash, err := s.userStore.GetUserByUsername(req.Username)
-	if err != nil || bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Println("GetUserByUsername error:", err)
+		writeError(w, 500, "failed to log in")
+		return
+	}
+	if err != nil {
+		hash = dummyPasswordHash // same bcrypt cost whether or not the user exists
+	}
+	ok := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) == nil && err == nil
+
+	if !ok {
+		var uid int64
+		if u != nil {
+			uid = u.ID
+		}
+		// counted before answering, so a 429 is never a free guess
+		wait, allowed := s.loginUserLimiter.Allow(userKey)
+		s.loginFailed(r, req.Username, uid)
+		if !allowed {
+			retryLater(w, wait)
+			return
+		}
 		writeError(w, 401, "invalid credentials")
 		return
 	}
 
-	token, err := generateJWT(u.ID)
+	// The right password from an IP the account has logged in from before
+	// and without recent failures gets in even while somebody else hammers
+	// the account; anyone else has to respect the account's backoff and
+	// lock. A locked account answers like a wrong password, so neither
+	// reveals that the username exists.
+	if !s.trustedLoginIP(u.ID, getIP(r)) {
+		if limited(w, s.loginUserLimiter, userKey) {
+			return
+		}
+		until, lerr := s.userStore.LockedUntil(u.ID)
+		if lerr != nil {
+			log.Println("LockedUntil error:", lerr)
+		}
+		if !until.IsZero() {
+			writeError(w, 401, "invalid credentials")
+			return
+		}
+	}
+	s.loginUserLimiter.Reset(userKey)
+
+	sessionID, err := s.startSession(u.ID, r, req.Device)
+	if err != nil {
+		log.Println("startSession error:", err)
+		writeError(w, 500, "failed to create session")
+		return
+	}
+
+	tokens, err := s.issueTokens(u.ID, sessionID, "")
 	if err != nil {
+		log.Println("issueTokens error:", err)
 		writeError(w, 500, "failed to create token")
 		return
 	}
 
-	writeJSON(w, 200, map[string]any{
-		"token": token,
-		"user":  u,
-	})
+	unread, err := unreadDirectMessageCounts(s.db, u.ID)
+	if err != nil {
+		log.Println("unreadDirectMessageCounts error:", err)
+	}
+
+	tokens["user"] = u
+	tokens["unreadDms"] = unread
+	writeJSON(w, 200, tokens)
 }
 
 // GET /auth/me (protected)
@@ -938,7 +1385,7 @@ func (s *Server) handleLobbyWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, err := parseJWT(tokenStr)
+	userID, sessionID, err := parseAccessToken(tokenStr)
 	if err != nil {
 		writeError(w, http.StatusUnauthorized, "invalid token")
 		return
@@ -956,11 +1403,50 @@ func (s *Server) handleLobbyWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Replay recent lobby chat before joining the hub
+	history, err := loadLobbyChat(s.db, userID, defaultLobbyRoom, 0, lobbyChatJoinHistory)
+	if err != nil {
+		log.Println("loadLobbyChat error:", err)
+	}
+	for _, m := range history {
+		data, err := json.Marshal(m)
+		if err != nil {
+			continue
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			log.Println("replay lobby chat write error:", err)
+			break
+		}
+	}
+
+	// Unread direct message counts, keyed by sender
+	if unread, err := unreadDirectMessageCounts(s.db, userID); err != nil {
+		log.Println("unreadDirectMessageCounts error:", err)
+	} else if data, err := json.Marshal(map[string]any{"type": "dmUnread", "counts": unread}); err == nil {
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			log.Println("dm unread write error:", err)
+		}
+	}
+
+	ignored, err := s.blockStore.Ignored(userID)
+	if err != nil {
+		log.Println("blockStore.Ignored error:", err)
+	}
+	friends, err := s.friendStore.FriendIDs(userID)
+	if err != nil {
+		log.Println("friendStore.FriendIDs error:", err)
+	}
+
 	client := &LobbyClient{
-		hub:  s.lobbyHub,
-		conn: conn,
-		send: make(chan []byte, 256),
-		user: user,
+		hub:     s.lobbyHub,
+		conn:    conn,
+		send:    make(chan []byte, 256),
+		user:    user,
+		db:      s.db,
+		room:    defaultLobbyRoom,
+		ignored: ignored,
+		friends: friends,
+		session: sessionID,
 	}
 
 	client.hub.register <- client
@@ -982,7 +1468,7 @@ func (s *Server) handleGameWS(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    userID, err := parseJWT(tokenStr)
+    userID, sessionID, err := parseAccessToken(tokenStr)
     if err != nil {
         writeError(w, http.StatusUnauthorized, "invalid token")
         return
@@ -1019,7 +1505,24 @@ func (s *Server) handleGameWS(w http.ResponseWriter, r *http.Request) {
     }
 
     // 2) Replay existing chat messages
-    chats, err := loadGameChat(s.db, gameID)
+    team := -1
+    var snap *GameMove
+    s.gameHub.states.with(s.db, gameID, func(st *GameState) {
+        team = st.TeamOf(userID)
+        if st.initialEdgeIDs() != nil {
+            m := st.Snapshot(gameID)
+            snap = &m
+        }
+    })
+
+    // Variants that pre-draw edges need the full board, not just the moves
+    if snap != nil {
+        if data, err := json.Marshal(snap); err == nil {
+            conn.WriteMessage(websocket.TextMessage, data)
+        }
+    }
+
+    chats, err := loadGameChat(s.db, gameID, team)
     if err != nil {
         log.Println("loadGameChat error:", err)
     } else {
@@ -1043,6 +1546,7 @@ func (s *Server) handleGameWS(w http.ResponseWriter, r *http.Request) {
         send:   make(chan []byte, 256),
         userID: userID,
         gameID: gameID,
+        session: sessionID,
     }
 
     s.gameHub.register <- client
@@ -1066,12 +1570,13 @@ func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 		tokenStr := strings.TrimPrefix(auth, "Bearer ")
-		uid, err := parseJWT(tokenStr)
+		uid, sessionID, err := parseAccessToken(tokenStr)
 		if err != nil {
 			writeError(w, 401, "invalid token")
 			return
 		}
 		ctx := context.WithValue(r.Context(), "userId", uid)
+		ctx = context.WithValue(ctx, "sessionId", sessionID)
 		next(w, r.WithContext(ctx))
 	}
 }
@@ -1085,7 +1590,7 @@ func withCORS(h http.Handler) http.Handler {
 
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(200)
@@ -1116,18 +1621,67 @@ func main() {
 
 	log.Println("Connected to Postgres")
 
+	if err := ensureSchema(db); err != nil {
+		log.Fatal("failed to prepare schema:", err)
+	}
+	if jwtKeys, err = loadKeyRing(); err != nil {
+		log.Fatal("failed to load JWT keys:", err)
+	}
+	if err := loadRevokedSessions(db); err != nil {
+		log.Fatal("failed to load revoked sessions:", err)
+	}
+
 	srv := NewServer(db)
 
 	// start lobby hub
 	go srv.lobbyHub.Run()
-	go srv.gameHub.Run()
+	go srv.tokenStore.RunJanitor(tokenJanitorInterval)
+	go backfillStats(db)
+	go backfillNameSkeletons(db)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", srv.handleHealth)
+	mux.HandleFunc("GET /auth/register-challenge", srv.handleRegisterChallenge)
 	mux.HandleFunc("/auth/register-token", srv.handleRegisterToken)
 	mux.HandleFunc("/auth/register", srv.handleRegister)
 	mux.HandleFunc("/auth/login", srv.handleLogin)
+	mux.HandleFunc("GET /.well-known/jwks.json", srv.handleJWKS)
+	mux.HandleFunc("POST /auth/refresh", srv.handleRefresh)
+	mux.HandleFunc("POST /auth/logout", srv.handleLogout)
 	mux.HandleFunc("/auth/me", srv.authMiddleware(srv.handleMe))
+	mux.HandleFunc("GET /api/users/{id}", srv.handleGetProfile)
+	mux.HandleFunc("GET /api/users/{id}/stats", srv.handleUserStats)
+	mux.HandleFunc("GET /api/users/{a}/vs/{b}", srv.handleHeadToHead)
+	mux.HandleFunc("PATCH /api/me", srv.authMiddleware(srv.handleUpdateProfile))
+	mux.HandleFunc("DELETE /api/me", srv.authMiddleware(srv.handleDeleteAccount))
+	mux.HandleFunc("GET /api/me/export", srv.authMiddleware(srv.handleExport))
+	mux.HandleFunc("POST /api/me/avatar", srv.authMiddleware(srv.handleUploadAvatar))
+	mux.HandleFunc("DELETE /api/me/avatar", srv.authMiddleware(srv.handleDeleteAvatar))
+	mux.HandleFunc("POST /auth/password", srv.authMiddleware(srv.handleChangePassword))
+	mux.HandleFunc("POST /auth/password/forgot", srv.handleForgotPassword)
+	mux.HandleFunc("POST /auth/password/reset", srv.handleResetPassword)
+	mux.HandleFunc("GET /auth/verify", srv.handleVerifyEmail)
+	mux.HandleFunc("POST /auth/email", srv.authMiddleware(srv.handleSetEmail))
+	mux.HandleFunc("GET /auth/sessions", srv.authMiddleware(srv.handleListSessions))
+	mux.HandleFunc("DELETE /auth/sessions/{id}", srv.authMiddleware(srv.handleRevokeSession))
+	mux.HandleFunc("/api/lobby/chat", srv.authMiddleware(srv.handleLobbyChatHistory))
+	mux.HandleFunc("/api/dms/{userId}", srv.authMiddleware(srv.handleDirectMessages))
+	mux.HandleFunc("GET /api/blocks", srv.authMiddleware(srv.handleListBlocks))
+	mux.HandleFunc("POST /api/blocks/{userId}", srv.authMiddleware(srv.handleSetRelation(relationBlock, true)))
+	mux.HandleFunc("DELETE /api/blocks/{userId}", srv.authMiddleware(srv.handleSetRelation(relationBlock, false)))
+	mux.HandleFunc("POST /api/mutes/{userId}", srv.authMiddleware(srv.handleSetRelation(relationMute, true)))
+	mux.HandleFunc("DELETE /api/mutes/{userId}", srv.authMiddleware(srv.handleSetRelation(relationMute, false)))
+	mux.HandleFunc("GET /api/friends", srv.authMiddleware(srv.handleListFriends))
+	mux.HandleFunc("POST /api/friends/{userId}", srv.authMiddleware(srv.handleFriendRequest))
+	mux.HandleFunc("POST /api/friends/{userId}/accept", srv.authMiddleware(srv.handleFriendAccept))
+	mux.HandleFunc("DELETE /api/friends/{userId}", srv.authMiddleware(srv.handleFriendRemove))
+	mux.HandleFunc("POST /api/games", srv.authMiddleware(srv.handleCreateGame))
+	mux.HandleFunc("POST /api/admin/users/{userId}/unlock", srv.adminMiddleware(srv.handleAdminUnlock))
+	mux.HandleFunc("POST /api/games/join", srv.authMiddleware(srv.handleJoinGame))
+	mux.HandleFunc("GET /api/layouts", srv.handleListLayouts)
+	if disk, ok := srv.blobs.(*diskBlobStore); ok {
+		mux.Handle("GET /media/", http.StripPrefix("/media/", disk.Handler()))
+	}
 	mux.HandleFunc("/ws/lobby", srv.handleLobbyWS)
 	mux.HandleFunc("/ws/game", srv.handleGameWS)
 
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// =====================
+// Passwords & Reset
+// =====================
+
+const passwordResetTTL = 30 * time.Minute
+
+var errResetInvalid = errors.New("invalid or expired reset token")
+
+// ResetStore keeps single-use password reset tokens. Like refresh tokens,
+// only their hashes are stored.
+type ResetStore struct {
+	db *sql.DB
+}
+
+func NewResetStore(db *sql.DB) *ResetStore {
+	return &ResetStore{db: db}
+}
+
+// Create issues a reset token for userID; earlier unused ones stop working.
+func (s *ResetStore) Create(userID int64, ip string) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`UPDATE password_resets SET used_at = now() WHERE user_id = $1 AND used_at IS NULL`,
+		userID,
+	); err != nil {
+		return "", err
+	}
+	token := newRefreshToken()
+	if _, err := tx.Exec(
+		`INSERT INTO password_resets (token_hash, user_id, ip, expires_at)
+         VALUES ($1, $2, $3, $4)`,
+		hashToken(token), userID, ip, time.Now().UTC().Add(passwordResetTTL),
+	); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// Consume marks the token used and returns its user.
+func (s *ResetStore) Consume(token string) (int64, error) {
+	var userID int64
+	err := s.db.QueryRow(
+		`UPDATE password_resets SET used_at = now()
+          WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+          RETURNING user_id`,
+		hashToken(token),
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errResetInvalid
+	}
+	return userID, err
+}
+
+// Username returns the username of a usable token's account without
+// spending the token, so the new password can be checked first.
+func (s *ResetStore) Username(token string) (string, error) {
+	var username string
+	err := s.db.QueryRow(
+		`SELECT u.username
+           FROM password_resets p JOIN users u ON u.id = p.user_id
+          WHERE p.token_hash = $1 AND p.used_at IS NULL AND p.expires_at > now()`,
+		hashToken(token),
+	).Scan(&username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errResetInvalid
+	}
+	return username, err
+}
+
+// checkPassword applies the password policy to a new password; see
+// validation.go.
+func checkPassword(password, username string) ValidationErrors {
+	errs := validationRules.Password(password, username)
+	for i := range errs {
+		errs[i].Field = "newPassword"
+	}
+	return errs
+}
+
+func (s *UserStore) PasswordHash(userID int64) (string, error) {
+	var hash string
+	err := s.db.QueryRow(`SELECT password_hash FROM users WHERE id = $1`, userID).Scan(&hash)
+	return hash, err
+}
+
+func (s *UserStore) Username(userID int64) (string, error) {
+	var username string
+	err := s.db.QueryRow(`SELECT username FROM users WHERE id = $1`, userID).Scan(&username)
+	return username, err
+}
+
+func (s *UserStore) SetPassword(userID int64, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE users SET password_hash = $2 WHERE id = $1`, userID, string(hash))
+	return err
+}
+
+// FindByLogin looks a user up by username or verified email for a reset
+// request.
+func (s *UserStore) FindByLogin(login string) (int64, string, error) {
+	var id int64
+	var email sql.NullString
+	err := s.db.QueryRow(
+		`SELECT id, email FROM users
+          WHERE lower(username) = lower($1) OR (lower(email) = lower($1) AND email_verified_at IS NOT NULL)`,
+		login,
+	).Scan(&id, &email)
+	return id, email.String, err
+}
+
+// revokeUserSessions logs a user out everywhere except keep.
+func (s *Server) revokeUserSessions(userID int64, keep string) {
+	sessions, err := s.sessionStore.List(userID)
+	if err != nil {
+		log.Println("List sessions error:", err)
+		return
+	}
+	for _, sess := range sessions {
+		if sess.ID == keep {
+			continue
+		}
+		if err := s.revokeSession(sess.ID); err != nil {
+			log.Println("revokeSession error:", err)
+		}
+	}
+}
+
+type changePasswordReq struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// POST /auth/password (protected) changes the password and logs out every
+// other session
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+	current, _ := r.Context().Value("sessionId").(string)
+
+	var req changePasswordReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, 400, "invalid JSON")
+		return
+	}
+	username, err := s.userStore.Username(uid)
+	if err != nil {
+		log.Println("Username error:", err)
+		writeError(w, 500, "failed to change password")
+		return
+	}
+	if errs := checkPassword(req.NewPassword, username); len(errs) > 0 {
+		writeValidation(w, errs)
+		return
+	}
+
+	hash, err := s.userStore.PasswordHash(uid)
+	if err != nil {
+		log.Println("PasswordHash error:", err)
+		writeError(w, 500, "failed to change password")
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.CurrentPassword)) != nil {
+		writeError(w, 403, "current password is wrong")
+		return
+	}
+
+	if err := s.userStore.SetPassword(uid, req.NewPassword); err != nil {
+		log.Println("SetPassword error:", err)
+		writeError(w, 500, "failed to change password")
+		return
+	}
+	s.revokeUserSessions(uid, current)
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+type forgotPasswordReq struct {
+	Login string `json:"login"` // username or email
+}
+
+// POST /auth/password/forgot mails a reset link. The answer is the same,
+// and comes as quickly, whether or not the account exists: the lookup and
+// the mail happen after it is sent, so it can't be used to probe for
+// usernames. Every request counts against the IP and the login.
+func (s *Server) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req forgotPasswordReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Login) == "" {
+		writeError(w, 400, "missing login")
+		return
+	}
+	login := strings.TrimSpace(req.Login)
+	ip := getIP(r)
+
+	ipKey, loginKey := ipLimitKey(ip), userLimitKey(login)
+	if limited(w, s.resetLimiter, ipKey, loginKey) {
+		return
+	}
+	s.resetLimiter.Fail(ipKey)
+	s.resetLimiter.Fail(loginKey)
+
+	go s.mailResetLink(login, ip)
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// mailResetLink sends a reset link to the account login names, if it has
+// an email address.
+func (s *Server) mailResetLink(login, ip string) {
+	uid, email, err := s.userStore.FindByLogin(login)
+	switch {
+	case errors.Is(err, sql.ErrNoRows), err == nil && email == "":
+		return // nothing to send
+	case err != nil:
+		log.Println("FindByLogin error:", err)
+		return
+	}
+
+	token, err := s.resetStore.Create(uid, ip)
+	if err != nil {
+		log.Println("Create reset token error:", err)
+		return
+	}
+	body := "Someone asked to reset the password of your Dots and Boxes account.\n\n" +
+		"Open this link within 30 minutes to choose a new one:\n" +
+		appLink("/reset-password?token="+token) + "\n\n" +
+		"If it wasn't you, ignore this email."
+	if err := s.mailer.Send(email, "Reset your password", body); err != nil {
+		log.Println("send reset mail error:", err)
+	}
+}
+
+type resetPasswordReq struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// POST /auth/password/reset sets a new password with a mailed token and
+// logs the account out everywhere
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		writeError(w, 400, "missing token")
+		return
+	}
+	username, err := s.resetStore.Username(req.Token)
+	if errors.Is(err, errResetInvalid) {
+		writeError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("reset token Username error:", err)
+		writeError(w, 500, "failed to reset password")
+		return
+	}
+	if errs := checkPassword(req.NewPassword, username); len(errs) > 0 {
+		writeValidation(w, errs)
+		return
+	}
+
+	uid, err := s.resetStore.Consume(req.Token)
+	if errors.Is(err, errResetInvalid) {
+		writeError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("Consume reset token error:", err)
+		writeError(w, 500, "failed to reset password")
+		return
+	}
+
+	if err := s.userStore.SetPassword(uid, req.NewPassword); err != nil {
+		log.Println("SetPassword error:", err)
+		writeError(w, 500, "failed to reset password")
+		return
+	}
+	s.revokeUserSessions(uid, "")
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
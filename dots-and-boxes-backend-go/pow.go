@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/bits"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// =====================
+// Registration Proof-of-Work
+// =====================
+
+// Before it gets a registration token a client has to solve a hashcash
+// puzzle: find a solution so that SHA-256(challenge + ":" + solution) starts
+// with REGISTER_POW_BITS zero bits (default 16, a second or two in a
+// browser; 0 turns the gate off). Challenges are signed tokens bound to the
+// client's IP, so nothing is stored until one is spent.
+
+const powChallengeTTL = 5 * time.Minute
+
+var powBits = powBitsFromEnv()
+
+var errPowInvalid = errors.New("invalid or expired challenge")
+
+func powBitsFromEnv() int {
+	if n, err := strconv.Atoi(os.Getenv("REGISTER_POW_BITS")); err == nil && n >= 0 && n <= 32 {
+		return n
+	}
+	return 16
+}
+
+func generatePowChallenge(ip string, difficulty int) (string, time.Time, error) {
+	exp := time.Now().UTC().Add(powChallengeTTL)
+	challenge, err := jwtKeys.sign(jwt.MapClaims{
+		"purpose": "registerPow",
+		"jti":     uuid.NewString(),
+		"ip":      ip,
+		"bits":    difficulty,
+		"exp":     exp.Unix(),
+	})
+	return challenge, exp, err
+}
+
+// verifyPow checks a solved challenge for ip and spends it.
+func verifyPow(challenge, solution, ip string) error {
+	token, err := jwt.Parse(challenge, jwtKeys.keyFunc, jwt.WithValidMethods(jwtKeys.methods()))
+	if err != nil || !token.Valid {
+		return errPowInvalid
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	purpose, _ := claims["purpose"].(string)
+	jti, _ := claims["jti"].(string)
+	boundIP, _ := claims["ip"].(string)
+	difficulty, ok := claims["bits"].(float64)
+	if purpose != "registerPow" || jti == "" || !ok || boundIP != ip {
+		return errPowInvalid
+	}
+
+	if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+solution))) < int(difficulty) {
+		return errors.New("wrong solution")
+	}
+	exp, _ := claims.GetExpirationTime()
+	if !spentChallenges.spend(jti, exp.Time) {
+		return errPowInvalid
+	}
+	return nil
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// spentChallenges remembers used challenges until they expire. It is per
+// instance; a challenge replayed on another instance still runs into the
+// per-IP token cap.
+var spentChallenges = &challengeLedger{spent: make(map[string]time.Time)}
+
+type challengeLedger struct {
+	mu    sync.Mutex
+	spent map[string]time.Time
+}
+
+// spend marks jti used, reporting false if it already was.
+func (l *challengeLedger) spend(jti string, expires time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for id, exp := range l.spent {
+		if now.After(exp) {
+			delete(l.spent, id)
+		}
+	}
+	if _, used := l.spent[jti]; used {
+		return false
+	}
+	l.spent[jti] = expires
+	return true
+}
+
+// GET /auth/register-challenge hands out a puzzle for POST /auth/register-token
+func (s *Server) handleRegisterChallenge(w http.ResponseWriter, r *http.Request) {
+	if powBits == 0 {
+		writeJSON(w, 200, map[string]any{"difficulty": 0})
+		return
+	}
+	challenge, exp, err := generatePowChallenge(getIP(r), powBits)
+	if err != nil {
+		writeError(w, 500, "failed to create challenge")
+		return
+	}
+	writeJSON(w, 200, map[string]any{
+		"challenge":  challenge,
+		"difficulty": powBits,
+		"algorithm":  "sha256",
+		"expiresAt":  exp.Format(time.RFC3339),
+	})
+}
+
+type registerTokenReq struct {
+	Challenge string `json:"challenge"`
+	Solution  string `json:"solution"`
+}
+
+// checkRegisterPow answers 400 and returns false unless the request
+// carries a solved challenge.
+func checkRegisterPow(w http.ResponseWriter, r *http.Request) bool {
+	if powBits == 0 {
+		return true
+	}
+	var req registerTokenReq
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.Challenge == "" || req.Solution == "" {
+		writeError(w, 400, "missing challenge solution")
+		return false
+	}
+	if err := verifyPow(req.Challenge, req.Solution, getIP(r)); err != nil {
+		writeError(w, 400, err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"testing"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestLeadingZeroBits(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix []byte
+		want   int
+	}{
+		{"high bit set", []byte{0x80}, 0},
+		{"low bit of first byte", []byte{0x01}, 7},
+		{"second byte", []byte{0x00, 0x0f}, 12},
+		{"three zero bytes", []byte{0x00, 0x00, 0x00, 0x40}, 25},
+		{"all zero", nil, 256},
+	}
+
+	for _, tt := range tests {
+		var sum [sha256.Size]byte
+		copy(sum[:], tt.prefix)
+		if len(tt.prefix) > 0 {
+			sum[sha256.Size-1] = 0xff // bits after the first set one don't count
+		}
+		if got := leadingZeroBits(sum); got != tt.want {
+			t.Errorf("%s: leadingZeroBits = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// solvePow finds a solution with at least bits leading zero bits, or, with
+// wrong set, one that falls short.
+func solvePow(challenge string, bits int, wrong bool) string {
+	for i := 0; ; i++ {
+		solution := strconv.Itoa(i)
+		ok := leadingZeroBits(sha256.Sum256([]byte(challenge+":"+solution))) >= bits
+		if ok != wrong {
+			return solution
+		}
+	}
+}
+
+func TestVerifyPow(t *testing.T) {
+	useTestKeys(t)
+
+	const ip, bits = "10.0.0.1", 8
+	newChallenge := func() string {
+		challenge, _, err := generatePowChallenge(ip, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return challenge
+	}
+	other, err := jwtKeys.sign(jwt.MapClaims{"purpose": "verifyEmail", "jti": "x", "ip": ip, "bits": bits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent := newChallenge()
+	if err := verifyPow(spent, solvePow(spent, bits, false), ip); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		challenge string
+		wrong     bool
+		ip        string
+		wantErr   bool
+	}{
+		{name: "solved", challenge: newChallenge(), ip: ip},
+		{name: "wrong solution", challenge: newChallenge(), wrong: true, ip: ip, wantErr: true},
+		{name: "other IP", challenge: newChallenge(), ip: "10.0.0.2", wantErr: true},
+		{name: "already spent", challenge: spent, ip: ip, wantErr: true},
+		{name: "not a challenge token", challenge: other, ip: ip, wantErr: true},
+		{name: "garbage", challenge: "not-a-jwt", ip: ip, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyPow(tt.challenge, solvePow(tt.challenge, bits, tt.wrong), tt.ip)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyPow error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+)
+
+// =====================
+// Lobby Presence
+// =====================
+
+const (
+	lobbyAwayAfter         = 5 * time.Minute
+	lobbyAwayCheckInterval = 30 * time.Second
+)
+
+type LobbyUser struct {
+	UserID      int64  `json:"userId"`
+	DisplayName string `json:"displayName"`
+	Status      string `json:"status"`           // "available", "inGame", "seeking", "away"
+	GameID      string `json:"gameId,omitempty"` // set when status is "inGame"
+	Rating      int    `json:"rating"`
+	GameCount   int    `json:"gameCount"` // games currently in progress
+	Country     string `json:"country,omitempty"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+}
+
+// LobbyPresence is the full list for a room, sent to a client when it
+// enters that room.
+type LobbyPresence struct {
+	Type  string      `json:"type"` // "presence"
+	Room  string      `json:"room"`
+	Users []LobbyUser `json:"users"`
+}
+
+// LobbyPresenceDiff is sent to a room whenever somebody joins, leaves or
+// changes.
+type LobbyPresenceDiff struct {
+	Type    string      `json:"type"` // "presenceDiff"
+	Room    string      `json:"room"`
+	Joined  []LobbyUser `json:"joined,omitempty"`
+	Left    []int64     `json:"left,omitempty"`
+	Changed []LobbyUser `json:"changed,omitempty"`
+}
+
+func (d *LobbyPresenceDiff) empty() bool {
+	return len(d.Joined) == 0 && len(d.Left) == 0 && len(d.Changed) == 0
+}
+
+type lobbyStatusChange struct {
+	client  *LobbyClient
+	seeking bool
+}
+
+// lobbyGameActivity is sent by the GameHub when a player's game socket
+// opens or closes, so the lobby can show them as in a game.
+type lobbyGameActivity struct {
+	UserID int64
+	GameID string
+	Joined bool
+}
+
+func (h *LobbyHub) applyGameActivity(act lobbyGameActivity) {
+	games := h.inGame[act.UserID]
+	if act.Joined {
+		if games == nil {
+			games = make(map[string]int)
+			h.inGame[act.UserID] = games
+		}
+		games[act.GameID]++
+		// a player who sat down is no longer looking for a match
+		for c := range h.clients {
+			if c.user.ID == act.UserID {
+				c.seeking = false
+			}
+		}
+	} else if games != nil {
+		games[act.GameID]--
+		if games[act.GameID] <= 0 {
+			delete(games, act.GameID)
+		}
+		if len(games) == 0 {
+			delete(h.inGame, act.UserID)
+		}
+	}
+	h.refreshPresence(act.UserID)
+}
+
+// buildPresence works out a user's entry in room from their open
+// connections. ok is false when the user has no connection in that room.
+func (h *LobbyHub) buildPresence(room string, userID int64) (LobbyUser, bool) {
+	var latest *LobbyClient
+	seeking := false
+	for c := range h.clients {
+		if c.user == nil || c.user.ID != userID || c.Room() != room {
+			continue
+		}
+		if latest == nil || c.lastActive.After(latest.lastActive) {
+			latest = c
+		}
+		if c.seeking {
+			seeking = true
+		}
+	}
+	if latest == nil {
+		return LobbyUser{}, false
+	}
+
+	displayName := latest.user.DisplayName
+	country, avatarURL := latest.user.Country, latest.user.AvatarURL
+	if p, ok := h.edited[userID]; ok {
+		displayName, country, avatarURL = p.DisplayName, p.Country, p.AvatarURL
+	}
+	if displayName == "" {
+		displayName = latest.user.Username
+	}
+	rating := latest.user.Rating
+	if r, ok := h.ratings[userID]; ok {
+		rating = r
+	}
+
+	entry := LobbyUser{
+		UserID:      userID,
+		DisplayName: displayName,
+		Status:      "available",
+		Rating:      rating,
+		GameCount:   len(h.inGame[userID]),
+		Country:     country,
+		AvatarURL:   avatarURL,
+	}
+
+	switch {
+	case entry.GameCount > 0:
+		gameIDs := make([]string, 0, entry.GameCount)
+		for id := range h.inGame[userID] {
+			gameIDs = append(gameIDs, id)
+		}
+		sort.Strings(gameIDs)
+		entry.Status = "inGame"
+		entry.GameID = gameIDs[0]
+	case time.Since(latest.lastActive) > lobbyAwayAfter:
+		entry.Status = "away"
+	case seeking:
+		entry.Status = "seeking"
+	}
+	return entry, true
+}
+
+// diffPresence records the user's current entry in diff.Room and adds any
+// change to diff.
+func (h *LobbyHub) diffPresence(userID int64, diff *LobbyPresenceDiff) {
+	entry, online := h.buildPresence(diff.Room, userID)
+	prev, had := h.presence[diff.Room][userID]
+
+	switch {
+	case online && !had:
+		if h.presence[diff.Room] == nil {
+			h.presence[diff.Room] = make(map[int64]LobbyUser)
+		}
+		h.presence[diff.Room][userID] = entry
+		diff.Joined = append(diff.Joined, entry)
+	case !online && had:
+		delete(h.presence[diff.Room], userID)
+		if len(h.presence[diff.Room]) == 0 {
+			delete(h.presence, diff.Room)
+		}
+		diff.Left = append(diff.Left, userID)
+	case online && entry != prev:
+		h.presence[diff.Room][userID] = entry
+		diff.Changed = append(diff.Changed, entry)
+	}
+}
+
+// refreshPresence re-evaluates a user in every room they are, or were, in.
+func (h *LobbyHub) refreshPresence(userID int64) {
+	rooms := make(map[string]bool)
+	for room, users := range h.presence {
+		if _, ok := users[userID]; ok {
+			rooms[room] = true
+		}
+	}
+	for c := range h.clients {
+		if c.user.ID == userID {
+			rooms[c.Room()] = true
+		}
+	}
+
+	for room := range rooms {
+		diff := LobbyPresenceDiff{Type: "presenceDiff", Room: room}
+		h.diffPresence(userID, &diff)
+		h.sendDiff(diff)
+	}
+}
+
+// refreshAll re-evaluates everybody, mainly to catch users going away.
+func (h *LobbyHub) refreshAll() {
+	rooms := make(map[string]map[int64]bool)
+	add := func(room string, userID int64) {
+		if rooms[room] == nil {
+			rooms[room] = make(map[int64]bool)
+		}
+		rooms[room][userID] = true
+	}
+	for room, users := range h.presence {
+		for id := range users {
+			add(room, id)
+		}
+	}
+	for c := range h.clients {
+		add(c.Room(), c.user.ID)
+	}
+
+	for room, userIDs := range rooms {
+		diff := LobbyPresenceDiff{Type: "presenceDiff", Room: room}
+		for id := range userIDs {
+			h.diffPresence(id, &diff)
+		}
+		h.sendDiff(diff)
+	}
+}
+
+func (h *LobbyHub) sendDiff(diff LobbyPresenceDiff) {
+	if diff.empty() {
+		return
+	}
+	data, err := json.Marshal(diff)
+	if err != nil {
+		log.Println("presence marshal error:", err)
+		return
+	}
+	h.deliver(diff.Room, data, 0)
+}
+
+// sendSnapshot gives a client the full presence list of its current room.
+func (h *LobbyHub) sendSnapshot(client *LobbyClient) {
+	if !h.clients[client] {
+		return
+	}
+	room := client.Room()
+	users := make([]LobbyUser, 0, len(h.presence[room]))
+	for _, u := range h.presence[room] {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserID < users[j].UserID })
+
+	data, err := json.Marshal(LobbyPresence{Type: "presence", Room: room, Users: users})
+	if err != nil {
+		log.Println("presence marshal error:", err)
+		return
+	}
+	h.sendTo(client, data)
+}
+
+// sendTo queues data for a single client if it is still connected.
+func (h *LobbyHub) sendTo(client *LobbyClient, data []byte) {
+	if client == nil || !h.clients[client] {
+		return
+	}
+	select {
+	case client.send <- data:
+	default:
+	}
+}
+
+// deliverToUsers sends data to every connection of the given users,
+// whatever room they are in.
+func (h *LobbyHub) deliverToUsers(userIDs []int64, data []byte) {
+	for c := range h.clients {
+		for _, id := range userIDs {
+			if c.user.ID == id {
+				h.sendTo(c, data)
+				break
+			}
+		}
+	}
+}
+
+func (h *LobbyHub) sendError(client *LobbyClient, text string) {
+	data, err := json.Marshal(map[string]string{"type": "error", "text": text})
+	if err != nil {
+		return
+	}
+	h.sendTo(client, data)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// =====================
+// Profiles & Avatars
+// =====================
+
+const (
+	maxBioLength    = 280
+	maxColors       = 2
+	maxAvatarBytes  = 2 << 20 // upload limit
+	maxAvatarPixels = 4096    // per side, checked before decoding
+	avatarSize      = 256     // stored avatars are square PNGs this wide
+)
+
+// Profile is the public view of a user. Email and security fields are
+// never part of it.
+type Profile struct {
+	User
+	Bio    string   `json:"bio"`
+	Colors []string `json:"colors"` // preferred line colors, "#rrggbb"
+}
+
+// lobbyProfile carries a profile edit to the lobby hub so presence shows
+// it without reconnecting.
+type lobbyProfile struct {
+	UserID      int64
+	DisplayName string
+	Country     string
+	AvatarURL   string
+}
+
+func (h *LobbyHub) applyProfile(p lobbyProfile) {
+	if !h.isOnline(p.UserID) {
+		return
+	}
+	h.edited[p.UserID] = p
+	h.refreshPresence(p.UserID)
+}
+
+func (s *Server) announceProfile(p *Profile) {
+	s.lobbyHub.profiles <- lobbyProfile{
+		UserID:      p.ID,
+		DisplayName: p.DisplayName,
+		Country:     p.Country,
+		AvatarURL:   p.AvatarURL,
+	}
+}
+
+func (s *UserStore) GetProfile(userID int64) (*Profile, error) {
+	var p Profile
+	var colors []byte
+	err := s.db.QueryRow(
+		`SELECT id, username, display_name, rating, created_at, country, COALESCE(avatar_url, ''), bio, colors
+		   FROM users WHERE id = $1`,
+		userID,
+	).Scan(&p.ID, &p.Username, &p.DisplayName, &p.Rating, &p.CreatedAt, &p.Country, &p.AvatarURL, &p.Bio, &colors)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(colors, &p.Colors); err != nil || p.Colors == nil {
+		p.Colors = []string{}
+	}
+	return &p, nil
+}
+
+// profileUpdate is a PATCH body; nil fields are left alone.
+type profileUpdate struct {
+	DisplayName *string   `json:"displayName"`
+	Bio         *string   `json:"bio"`
+	Country     *string   `json:"country"`
+	Colors      *[]string `json:"colors"`
+}
+
+// validate normalizes the fields that are set and reports every problem.
+func (u *profileUpdate) validate() ValidationErrors {
+	var errs ValidationErrors
+	if u.DisplayName != nil {
+		name, nameErrs := validationRules.DisplayName(*u.DisplayName)
+		errs = append(errs, nameErrs...)
+		u.DisplayName = &name
+	}
+	if u.Bio != nil {
+		bio := strings.TrimSpace(norm.NFC.String(*u.Bio))
+		switch {
+		case utf8.RuneCountInString(bio) > maxBioLength:
+			errs.add("bio", "length", "must be at most "+strconv.Itoa(maxBioLength)+" characters")
+		case strings.ContainsFunc(bio, func(ch rune) bool { return ch != '\n' && unicode.IsControl(ch) }):
+			errs.add("bio", "charset", "contains control characters")
+		}
+		u.Bio = &bio
+	}
+	if u.Country != nil {
+		country := strings.ToUpper(strings.TrimSpace(*u.Country))
+		if country != "" {
+			region, err := language.ParseRegion(country)
+			if err != nil || len(country) != 2 || !region.IsCountry() {
+				errs.add("country", "invalid", "must be an ISO 3166 country code")
+			}
+		}
+		u.Country = &country
+	}
+	if u.Colors != nil {
+		colors := *u.Colors
+		if len(colors) > maxColors {
+			errs.add("colors", "length", "at most "+strconv.Itoa(maxColors)+" colors")
+		}
+		for i, c := range colors {
+			if !colorPattern.MatchString(c) {
+				errs.add("colors", "invalid", "colors must look like #1a2b3c")
+				break
+			}
+			colors[i] = strings.ToLower(c)
+		}
+	}
+	return errs
+}
+
+func (s *UserStore) UpdateProfile(userID int64, u profileUpdate) error {
+	var colors, skeleton *string
+	if u.Colors != nil {
+		data, _ := json.Marshal(*u.Colors)
+		colors = new(string)
+		*colors = string(data)
+	}
+	if u.DisplayName != nil {
+		skeleton = new(string)
+		*skeleton = confusableSkeleton(*u.DisplayName)
+	}
+	_, err := s.db.Exec(
+		`UPDATE users SET
+		        display_name     = COALESCE($2, display_name),
+		        bio              = COALESCE($3, bio),
+		        country          = COALESCE($4, country),
+		        colors           = COALESCE($5::jsonb, colors),
+		        display_skeleton = COALESCE($6, display_skeleton)
+		  WHERE id = $1`,
+		userID, u.DisplayName, u.Bio, u.Country, colors, skeleton,
+	)
+	return err
+}
+
+// SetAvatar stores the new avatar ("" clears it) and returns the old key
+// so its file can be removed.
+func (s *UserStore) SetAvatar(userID int64, key, url string) (string, error) {
+	var old sql.NullString
+	err := s.db.QueryRow(
+		`UPDATE users u SET avatar_key = NULLIF($2, ''), avatar_url = NULLIF($3, '')
+		   FROM (SELECT avatar_key FROM users WHERE id = $1 FOR UPDATE) prev
+		  WHERE u.id = $1
+		  RETURNING prev.avatar_key`,
+		userID, key, url,
+	).Scan(&old)
+	return old.String, err
+}
+
+// GET /api/users/{id}
+func (s *Server) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, 400, "invalid user id")
+		return
+	}
+	p, err := s.userStore.GetProfile(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, 404, "user not found")
+		return
+	}
+	if err != nil {
+		log.Println("GetProfile error:", err)
+		writeError(w, 500, "failed to load profile")
+		return
+	}
+	writeJSON(w, 200, p)
+}
+
+// PATCH /api/me (protected) edits display name, bio, country and colors
+func (s *Server) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+
+	var req profileUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, 400, "invalid JSON")
+		return
+	}
+	errs := req.validate()
+	if len(errs) == 0 && req.DisplayName != nil {
+		errs = s.checkLookalikeName(*req.DisplayName, uid)
+	}
+	if len(errs) > 0 {
+		writeValidation(w, errs)
+		return
+	}
+
+	if err := s.userStore.UpdateProfile(uid, req); err != nil {
+		log.Println("UpdateProfile error:", err)
+		writeError(w, 500, "failed to update profile")
+		return
+	}
+	s.profileChanged(w, uid)
+}
+
+// profileChanged answers with the stored profile and updates the lobby.
+func (s *Server) profileChanged(w http.ResponseWriter, uid int64) {
+	p, err := s.userStore.GetProfile(uid)
+	if err != nil {
+		log.Println("GetProfile error:", err)
+		writeError(w, 500, "failed to load profile")
+		return
+	}
+	s.announceProfile(p)
+	writeJSON(w, 200, p)
+}
+
+// POST /api/me/avatar (protected) takes a PNG, JPEG or GIF, either as the
+// multipart field "avatar" or as the raw body, and stores it as a square
+// PNG
+func (s *Server) handleUploadAvatar(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarBytes+64<<10) // room for multipart headers
+	var src io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("avatar")
+		if err != nil {
+			writeError(w, 400, "missing avatar file")
+			return
+		}
+		defer file.Close()
+		src = file
+	}
+	data, err := io.ReadAll(io.LimitReader(src, maxAvatarBytes+1))
+	if err != nil || len(data) > maxAvatarBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "avatar must be at most 2 MB")
+		return
+	}
+
+	img, err := decodeAvatar(data)
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	var out bytes.Buffer
+	if err := png.Encode(&out, resizeSquare(img, avatarSize)); err != nil {
+		log.Println("avatar encode error:", err)
+		writeError(w, 500, "failed to store avatar")
+		return
+	}
+
+	key := "avatars/" + strconv.FormatInt(uid, 10) + "-" + uuid.NewString() + ".png"
+	if err := s.blobs.Put(key, out.Bytes(), "image/png"); err != nil {
+		log.Println("avatar Put error:", err)
+		writeError(w, 500, "failed to store avatar")
+		return
+	}
+	old, err := s.userStore.SetAvatar(uid, key, s.blobs.URL(key))
+	if err != nil {
+		log.Println("SetAvatar error:", err)
+		s.blobs.Delete(key)
+		writeError(w, 500, "failed to store avatar")
+		return
+	}
+	s.dropBlob(old)
+	s.profileChanged(w, uid)
+}
+
+// DELETE /api/me/avatar (protected)
+func (s *Server) handleDeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+
+	old, err := s.userStore.SetAvatar(uid, "", "")
+	if err != nil {
+		log.Println("SetAvatar error:", err)
+		writeError(w, 500, "failed to remove avatar")
+		return
+	}
+	s.dropBlob(old)
+	s.profileChanged(w, uid)
+}
+
+func (s *Server) dropBlob(key string) {
+	if key == "" {
+		return
+	}
+	if err := s.blobs.Delete(key); err != nil {
+		log.Println("blob Delete error:", err)
+	}
+}
+
+// decodeAvatar checks the real file type and size before decoding, so a
+// small file claiming huge dimensions is refused cheaply.
+func decodeAvatar(data []byte) (image.Image, error) {
+	switch http.DetectContentType(data) {
+	case "image/png", "image/jpeg", "image/gif":
+	default:
+		return nil, errors.New("avatar must be a PNG, JPEG or GIF image")
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("unreadable image")
+	}
+	if cfg.Width > maxAvatarPixels || cfg.Height > maxAvatarPixels || cfg.Width < 1 || cfg.Height < 1 {
+		return nil, errors.New("avatar must be at most " + strconv.Itoa(maxAvatarPixels) + " pixels per side")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("unreadable image")
+	}
+	return img, nil
+}
+
+// resizeSquare crops img to its centered square and scales it to size
+// (or less, for smaller images) by averaging each target pixel's source
+// area.
+func resizeSquare(img image.Image, size int) *image.NRGBA {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	size = min(size, side)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for ty := 0; ty < size; ty++ {
+		sy0, sy1 := y0+ty*side/size, y0+(ty+1)*side/size
+		for tx := 0; tx < size; tx++ {
+			sx0, sx1 := x0+tx*side/size, x0+(tx+1)*side/size
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					c := color.NRGBA64Model.Convert(img.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(tx, ty, color.NRGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
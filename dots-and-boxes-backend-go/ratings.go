@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"sort"
+)
+
+// =====================
+// Results & Ratings
+// =====================
+
+// eloK is the two-player K factor. In an N-player game each seat is
+// compared with every other seat, so K is split across the N-1 pairings.
+const eloK = 32.0
+
+type GameResult struct {
+	Seat        int    `json:"seat"`
+	Slot        string `json:"slot"`
+	UserID      int64  `json:"userId"`
+	Score       int    `json:"score"`
+	Place       int    `json:"place"` // 1 = winner, ties share a place
+	RatingDelta int    `json:"ratingDelta"`
+}
+
+// placesFor ranks scores highest first; equal scores share a place
+// ("1, 2, 2, 4").
+func placesFor(scores []int) []int {
+	order := make([]int, len(scores))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+
+	places := make([]int, len(scores))
+	for rank, seat := range order {
+		if rank > 0 && scores[seat] == scores[order[rank-1]] {
+			places[seat] = places[order[rank-1]]
+		} else {
+			places[seat] = rank + 1
+		}
+	}
+	return places
+}
+
+// multiEloDeltas treats an N-player result as every pair of seats playing
+// each other: a better place is a win, the same place a draw.
+func multiEloDeltas(ratings, places []int) []int {
+	n := len(ratings)
+	deltas := make([]int, n)
+	if n < 2 {
+		return deltas
+	}
+	k := eloK / float64(n-1)
+
+	for i := range n {
+		var sum float64
+		for j := range n {
+			if i == j {
+				continue
+			}
+			expected := 1 / (1 + math.Pow(10, float64(ratings[j]-ratings[i])/400))
+			actual := 0.5
+			switch {
+			case places[i] < places[j]:
+				actual = 1
+			case places[i] > places[j]:
+				actual = 0
+			}
+			sum += k * (actual - expected)
+		}
+		deltas[i] = int(math.Round(sum))
+	}
+	return deltas
+}
+
+// resignedLast puts index loser behind everyone else; the others keep
+// their order, closing the gap it leaves.
+func resignedLast(places []int, loser int) []int {
+	out := make([]int, len(places))
+	for i := range places {
+		if i == loser {
+			out[i] = len(places)
+			continue
+		}
+		out[i] = 1
+		for j := range places {
+			if j != loser && places[j] < places[i] {
+				out[i]++
+			}
+		}
+	}
+	return out
+}
+
+// CompleteGame finishes a game, records each seat's score and place and,
+// for rated games, updates ratings. resigned is the seat that ended the
+// game early (-1 if it was played to the end); that seat, or its team,
+// places last whatever the score. It returns nil results if the game was
+// already finished.
+func (s *GameStore) CompleteGame(g *Game, scores []int, resigned int) ([]GameResult, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE games SET status = 'finished', finished_at = now()
+          WHERE id = $1 AND status <> 'finished'`,
+		g.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+
+	ratings := make([]int, len(scores))
+	if g.Settings.Rated {
+		for seat := range scores {
+			err := tx.QueryRow(`SELECT rating FROM users WHERE id = $1 FOR UPDATE`, g.PlayerIDs[seat]).Scan(&ratings[seat])
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+		}
+	}
+
+	// In team games both teammates share the team's place and rating change
+	var places, deltas []int
+	if g.Settings.Teams != nil {
+		places, deltas = teamResults(g.Settings, scores, ratings, resigned)
+	} else {
+		places = rulesFor(g.Settings).Places(scores)
+		if resigned >= 0 {
+			places = resignedLast(places, resigned)
+		}
+		deltas = multiEloDeltas(ratings, places)
+	}
+
+	results := make([]GameResult, len(scores))
+	for seat := range scores {
+		results[seat] = GameResult{
+			Seat:   seat,
+			Slot:   seatSlot(seat),
+			UserID: g.PlayerIDs[seat],
+			Score:  scores[seat],
+			Place:  places[seat],
+		}
+		if !g.Settings.Rated {
+			continue
+		}
+		results[seat].RatingDelta = deltas[seat]
+		if _, err := tx.Exec(
+			`UPDATE users SET rating = rating + $2 WHERE id = $1`,
+			g.PlayerIDs[seat], deltas[seat],
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range results {
+		if _, err := tx.Exec(
+			`UPDATE game_players SET score = $3, place = $4, rating_delta = $5
+              WHERE game_id = $1 AND seat = $2`,
+			g.ID, r.Seat, r.Score, r.Place, r.RatingDelta,
+		); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if err := countGame(s.db, g.ID); err != nil {
+		log.Println("countGame error:", err)
+	}
+	return results, nil
+}
+
+// finishGame runs once the last box is taken or a player resigns: it
+// stores the result and announces it to the room and to the players'
+// friends.
+func (c *GameClient) finishGame(settings GameSettings, playerIDs []int64, scores []int, resigned int) {
+	out := GameMove{Type: "gameOver", GameID: c.gameID, Scores: make(map[string]int)}
+	if resigned >= 0 {
+		out.PlayerSlot = seatSlot(resigned)
+	}
+	for seat, score := range scores {
+		out.Scores[seatSlot(seat)] = score
+	}
+	out.TeamScores = teamScores(settings, scores)
+
+	// friends hear about a game once, from whichever call finished it
+	announce := c.db == nil
+	if c.db != nil && len(playerIDs) == len(scores) {
+		g := &Game{ID: c.gameID, Settings: settings, PlayerIDs: playerIDs}
+		results, err := NewGameStore(c.db).CompleteGame(g, scores, resigned)
+		if err != nil {
+			log.Println("CompleteGame error:", err)
+		}
+		out.Results = results
+		announce = results != nil
+	}
+	c.hub.broadcast <- out
+
+	if announce && c.hub.lobby != nil {
+		c.hub.lobby.gameOvers <- lobbyGameOver{GameID: c.gameID, PlayerIDs: playerIDs, Ratings: c.newRatings(out.Results)}
+	}
+}
+
+// newRatings reads back the ratings a rated game changed, for presence.
+func (c *GameClient) newRatings(results []GameResult) map[int64]int {
+	ratings := make(map[int64]int)
+	users := NewUserStore(c.db)
+	for _, r := range results {
+		if r.RatingDelta == 0 || r.UserID == 0 {
+			continue
+		}
+		u, err := users.GetUserByID(r.UserID)
+		if err != nil {
+			log.Println("GetUserByID error:", err)
+			continue
+		}
+		ratings[r.UserID] = u.Rating
+	}
+	return ratings
+}
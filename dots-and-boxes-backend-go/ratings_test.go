@@ -0,0 +1,77 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPlacesFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		scores []int
+		want   []int
+	}{
+		{"two players", []int{5, 3}, []int{1, 2}},
+		{"second seat wins", []int{3, 5}, []int{2, 1}},
+		{"draw", []int{4, 4}, []int{1, 1}},
+		{"shared second place skips third", []int{1, 4, 4, 2}, []int{4, 1, 1, 3}},
+		{"everyone tied", []int{2, 2, 2}, []int{1, 1, 1}},
+		{"no seats", []int{}, []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := placesFor(tt.scores); !slices.Equal(got, tt.want) {
+				t.Errorf("placesFor(%v) = %v, want %v", tt.scores, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiEloDeltas(t *testing.T) {
+	tests := []struct {
+		name    string
+		ratings []int
+		places  []int
+		want    []int
+	}{
+		{"even match", []int{1500, 1500}, []int{1, 2}, []int{16, -16}},
+		{"even draw", []int{1500, 1500}, []int{1, 1}, []int{0, 0}},
+		{"upset pays more", []int{1400, 1600}, []int{1, 2}, []int{24, -24}},
+		{"favourite wins less", []int{1600, 1400}, []int{1, 2}, []int{8, -8}},
+		{"three players split K", []int{1500, 1500, 1500}, []int{1, 2, 3}, []int{16, 0, -16}},
+		{"four players, shared second", []int{1500, 1500, 1500, 1500}, []int{1, 2, 2, 4}, []int{16, 0, 0, -16}},
+		{"single seat", []int{1500}, []int{1}, []int{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := multiEloDeltas(tt.ratings, tt.places)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("multiEloDeltas(%v, %v) = %v, want %v", tt.ratings, tt.places, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResignedLast(t *testing.T) {
+	tests := []struct {
+		name   string
+		places []int
+		loser  int
+		want   []int
+	}{
+		{"leader resigns", []int{1, 2}, 0, []int{2, 1}},
+		{"trailer resigns", []int{1, 2}, 1, []int{1, 2}},
+		{"resigning from a draw", []int{1, 1}, 1, []int{1, 2}},
+		{"others close the gap", []int{1, 2, 2, 4}, 1, []int{1, 4, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resignedLast(tt.places, tt.loser); !slices.Equal(got, tt.want) {
+				t.Errorf("resignedLast(%v, %d) = %v, want %v", tt.places, tt.loser, got, tt.want)
+			}
+		})
+	}
+}
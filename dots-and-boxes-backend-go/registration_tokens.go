@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// =====================
+// Registration Token
+// =====================
+
+// TokenStore hands out and checks the short-lived tokens needed to
+// register. Where they are kept is up to its backend: Postgres by default,
+// so tokens survive restarts and work behind several instances, or memory
+// with REGISTRATION_TOKEN_STORE=memory. REGISTRATION_TOKENS_PER_IP caps how
+// many unexpired tokens one IP may hold.
+
+const (
+	defaultTokensPerIP   = 5
+	tokenJanitorInterval = time.Minute
+)
+
+var errTooManyTokens = errors.New("too many open registration tokens, use one first")
+
+type RegistrationToken struct {
+	Token     string
+	IP        string
+	UserAgent string
+	ExpiresAt time.Time
+}
+
+// TokenBackend stores registration tokens. Delete reports whether this
+// call removed the token, so only one caller can consume it.
+type TokenBackend interface {
+	// Insert adds t unless its IP already holds maxPerIP unexpired tokens.
+	Insert(t RegistrationToken, maxPerIP int) error
+	Get(token string) (RegistrationToken, bool, error)
+	Delete(token string) (bool, error)
+	DeleteExpired(now time.Time) (int64, error)
+}
+
+type TokenStore struct {
+	backend  TokenBackend
+	maxPerIP int
+}
+
+func NewTokenStore(backend TokenBackend) *TokenStore {
+	maxPerIP := defaultTokensPerIP
+	if n, err := strconv.Atoi(os.Getenv("REGISTRATION_TOKENS_PER_IP")); err == nil && n > 0 {
+		maxPerIP = n
+	}
+	return &TokenStore{backend: backend, maxPerIP: maxPerIP}
+}
+
+func newTokenBackendFromEnv(db *sql.DB) TokenBackend {
+	if os.Getenv("REGISTRATION_TOKEN_STORE") == "memory" || db == nil {
+		return newMemoryTokenBackend()
+	}
+	return &pgTokenBackend{db: db}
+}
+
+func (s *TokenStore) CreateRegistrationToken(ip, ua string, ttl time.Duration) (RegistrationToken, error) {
+	t := RegistrationToken{
+		Token:     uuid.NewString(),
+		IP:        ip,
+		UserAgent: ua,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	}
+	if err := s.backend.Insert(t, s.maxPerIP); err != nil {
+		return RegistrationToken{}, err
+	}
+	return t, nil
+}
+
+func (s *TokenStore) ValidateAndConsume(tokenStr, ip, ua string) (RegistrationToken, bool, string) {
+	token, ok, err := s.backend.Get(tokenStr)
+	if err != nil {
+		log.Println("token backend error:", err)
+		return RegistrationToken{}, false, "try again later"
+	}
+	if !ok {
+		return RegistrationToken{}, false, "token not found"
+	}
+	if time.Now().UTC().After(token.ExpiresAt) {
+		s.backend.Delete(tokenStr)
+		return RegistrationToken{}, false, "token expired"
+	}
+	if token.IP != ip {
+		return RegistrationToken{}, false, "IP mismatch"
+	}
+	if token.UserAgent != ua {
+		return RegistrationToken{}, false, "User-Agent mismatch"
+	}
+
+	// another request (or instance) may have used it since the Get
+	deleted, err := s.backend.Delete(tokenStr)
+	if err != nil {
+		log.Println("token backend error:", err)
+		return RegistrationToken{}, false, "try again later"
+	}
+	if !deleted {
+		return RegistrationToken{}, false, "token not found"
+	}
+	return token, true, ""
+}
+
+// RunJanitor removes expired tokens every interval, including ones nobody
+// ever comes back for.
+func (s *TokenStore) RunJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if _, err := s.backend.DeleteExpired(now.UTC()); err != nil {
+			log.Println("token janitor error:", err)
+		}
+	}
+}
+
+// memoryTokenBackend is for a single instance; tokens are lost on restart.
+type memoryTokenBackend struct {
+	mu     sync.Mutex
+	tokens map[string]RegistrationToken
+}
+
+func newMemoryTokenBackend() *memoryTokenBackend {
+	return &memoryTokenBackend{tokens: make(map[string]RegistrationToken)}
+}
+
+func (b *memoryTokenBackend) Insert(t RegistrationToken, maxPerIP int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().UTC()
+	held := 0
+	for _, other := range b.tokens {
+		if other.IP == t.IP && now.Before(other.ExpiresAt) {
+			held++
+		}
+	}
+	if maxPerIP > 0 && held >= maxPerIP {
+		return errTooManyTokens
+	}
+	b.tokens[t.Token] = t
+	return nil
+}
+
+func (b *memoryTokenBackend) Get(token string) (RegistrationToken, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.tokens[token]
+	return t, ok, nil
+}
+
+func (b *memoryTokenBackend) Delete(token string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.tokens[token]
+	delete(b.tokens, token)
+	return ok, nil
+}
+
+func (b *memoryTokenBackend) DeleteExpired(now time.Time) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var n int64
+	for key, t := range b.tokens {
+		if now.After(t.ExpiresAt) {
+			delete(b.tokens, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// pgTokenBackend keeps tokens in registration_tokens, shared by every
+// instance on the database.
+type pgTokenBackend struct {
+	db *sql.DB
+}
+
+func (b *pgTokenBackend) Insert(t RegistrationToken, maxPerIP int) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// serialize inserts per IP so concurrent requests can't both pass the cap
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('registration_tokens:' || $1))`, t.IP); err != nil {
+		return err
+	}
+	if maxPerIP > 0 {
+		var held int
+		if err := tx.QueryRow(
+			`SELECT count(*) FROM registration_tokens WHERE ip = $1 AND expires_at > now()`,
+			t.IP,
+		).Scan(&held); err != nil {
+			return err
+		}
+		if held >= maxPerIP {
+			return errTooManyTokens
+		}
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO registration_tokens (token, ip, user_agent, expires_at) VALUES ($1, $2, $3, $4)`,
+		t.Token, t.IP, t.UserAgent, t.ExpiresAt,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (b *pgTokenBackend) Get(token string) (RegistrationToken, bool, error) {
+	t := RegistrationToken{Token: token}
+	err := b.db.QueryRow(
+		`SELECT ip, user_agent, expires_at FROM registration_tokens WHERE token = $1`,
+		token,
+	).Scan(&t.IP, &t.UserAgent, &t.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RegistrationToken{}, false, nil
+	}
+	if err != nil {
+		return RegistrationToken{}, false, err
+	}
+	t.ExpiresAt = t.ExpiresAt.UTC()
+	return t, true, nil
+}
+
+func (b *pgTokenBackend) Delete(token string) (bool, error) {
+	res, err := b.db.Exec(`DELETE FROM registration_tokens WHERE token = $1`, token)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (b *pgTokenBackend) DeleteExpired(now time.Time) (int64, error) {
+	res, err := b.db.Exec(`DELETE FROM registration_tokens WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
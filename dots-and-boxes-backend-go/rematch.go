@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// =====================
+// Rematch
+// =====================
+
+// rematchOffers remembers, per finished game, which players asked for or
+// agreed to a rematch until everyone has answered.
+type rematchOffers struct {
+	mu     sync.Mutex
+	offers map[string]map[int64]bool // gameID -> userIDs that agreed
+}
+
+func newRematchOffers() *rematchOffers {
+	return &rematchOffers{offers: make(map[string]map[int64]bool)}
+}
+
+// offer records userID's agreement. Once every one of the game's players
+// has agreed the offer is consumed and accepted is true. A lone offer
+// reports first so the caller can announce it.
+func (ro *rematchOffers) offer(gameID string, userID int64, players int) (first, accepted bool) {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+
+	agreed, ok := ro.offers[gameID]
+	if !ok {
+		agreed = make(map[int64]bool)
+		ro.offers[gameID] = agreed
+	}
+	agreed[userID] = true
+	if len(agreed) >= players {
+		delete(ro.offers, gameID)
+		return false, true
+	}
+	return !ok, false
+}
+
+// pending reports whether somebody has offered a rematch for gameID.
+func (ro *rematchOffers) pending(gameID string) bool {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	return len(ro.offers[gameID]) > 0
+}
+
+func (ro *rematchOffers) clear(gameID string) {
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	delete(ro.offers, gameID)
+}
+
+// finishedGameFor loads the client's game if it is over and they played in it.
+func (c *GameClient) finishedGameFor() *Game {
+	if c.db == nil {
+		return nil
+	}
+	g, err := NewGameStore(c.db).GetGame(c.gameID)
+	if err != nil {
+		log.Println("GetGame error:", err)
+		return nil
+	}
+	if g.Status != "finished" {
+		return nil
+	}
+	for _, id := range g.PlayerIDs {
+		if id == c.userID {
+			return g
+		}
+	}
+	return nil
+}
+
+// unavailablePlayer returns the first player of g who can't be paired
+// with the client again, because their account is gone or one of them
+// blocked the other, or 0. Every player has to agree to a rematch, so
+// each pair gets checked by one of them. Errors count as unavailable.
+func (c *GameClient) unavailablePlayer(g *Game) int64 {
+	users, blocks := NewUserStore(c.db), NewBlockStore(c.db)
+	for _, id := range g.PlayerIDs {
+		deleted, err := users.Deleted(id)
+		if err != nil {
+			log.Println("Deleted error:", err)
+			return id
+		}
+		blocked := false
+		if id != c.userID {
+			if blocked, err = blocks.EitherBlocked(c.userID, id); err != nil {
+				log.Println("EitherBlocked error:", err)
+				return id
+			}
+		}
+		if deleted || blocked {
+			return id
+		}
+	}
+	return 0
+}
+
+// handleRematch deals with "rematch", "rematchAccept" and "rematchDecline".
+func (c *GameClient) handleRematch(kind string) {
+	old := c.finishedGameFor()
+	if old == nil {
+		return
+	}
+
+	switch kind {
+	case "rematch", "rematchAccept":
+		if kind == "rematchAccept" && !c.hub.rematches.pending(c.gameID) {
+			return
+		}
+		// a deleted account or a block since the game means no
+		if id := c.unavailablePlayer(old); id != 0 {
+			c.hub.rematches.clear(c.gameID)
+			c.hub.broadcast <- GameMove{Type: "rematchDeclined", GameID: c.gameID, UserID: id}
+			return
+		}
+		first, accepted := c.hub.rematches.offer(c.gameID, c.userID, len(old.PlayerIDs))
+		if !accepted {
+			msgType := "rematchAccepted"
+			if first {
+				msgType = "rematchOffer"
+			}
+			c.hub.broadcast <- GameMove{Type: msgType, GameID: c.gameID, UserID: c.userID}
+			return
+		}
+	case "rematchDecline":
+		c.hub.rematches.clear(c.gameID)
+		c.hub.broadcast <- GameMove{Type: "rematchDeclined", GameID: c.gameID, UserID: c.userID}
+		return
+	}
+
+	// Same settings and seats, so teams and colors stay put; the turn
+	// order is rotated so the next player moves first
+	settings := old.Settings
+	settings.TurnOrder = append(append([]int{}, old.Settings.TurnOrder[1:]...), old.Settings.TurnOrder[0])
+	g := &Game{
+		ID:        uuid.NewString(),
+		Status:    "active",
+		Settings:  settings,
+		PlayerIDs: old.PlayerIDs,
+		CreatedBy: c.userID,
+	}
+	if err := NewGameStore(c.db).CreateGame(g); err != nil {
+		log.Println("CreateGame error:", err)
+		return
+	}
+	gameRegistry.Register(g.ID, g.PlayerIDs)
+
+	c.hub.broadcast <- GameMove{
+		Type:      "rematchStart",
+		GameID:    c.gameID,
+		NewGameID: g.ID,
+		PlayerIDs: g.PlayerIDs,
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// =====================
+// Lobby Rooms
+// =====================
+
+const defaultLobbyRoom = "general"
+
+var roomNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,31}$`)
+
+// normalizeRoomName accepts "#General" as well as "general".
+func normalizeRoomName(name string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#"))
+}
+
+type LobbyRoom struct {
+	Name    string `json:"name"`
+	Private bool   `json:"private"`
+	OwnerID int64  `json:"ownerId,omitempty"`
+	Joined  bool   `json:"joined"` // the requesting user is a stored member
+	Online  int    `json:"online"` // users currently in the room
+}
+
+type RoomStore struct {
+	db *sql.DB
+}
+
+func NewRoomStore(db *sql.DB) *RoomStore {
+	return &RoomStore{db: db}
+}
+
+// GetRoom returns the room, or sql.ErrNoRows if it doesn't exist.
+func (s *RoomStore) GetRoom(name string) (*LobbyRoom, error) {
+	var room LobbyRoom
+	var ownerID sql.NullInt64
+	err := s.db.QueryRow(
+		`SELECT name, private, owner_id FROM lobby_rooms WHERE name = $1`,
+		name,
+	).Scan(&room.Name, &room.Private, &ownerID)
+	if err != nil {
+		return nil, err
+	}
+	room.OwnerID = ownerID.Int64
+	return &room, nil
+}
+
+// ListRooms returns every public room plus the private rooms userID belongs to.
+func (s *RoomStore) ListRooms(userID int64) ([]LobbyRoom, error) {
+	rows, err := s.db.Query(
+		`SELECT r.name, r.private, r.owner_id, m.user_id IS NOT NULL
+           FROM lobby_rooms r
+           LEFT JOIN lobby_room_members m ON m.room_name = r.name AND m.user_id = $1
+          WHERE NOT r.private OR m.user_id IS NOT NULL
+          ORDER BY r.created_at ASC, r.name ASC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []LobbyRoom
+	for rows.Next() {
+		var room LobbyRoom
+		var ownerID sql.NullInt64
+		if err := rows.Scan(&room.Name, &room.Private, &ownerID, &room.Joined); err != nil {
+			return nil, err
+		}
+		room.OwnerID = ownerID.Int64
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// CreateRoom creates a custom room owned by ownerID and makes them a member.
+func (s *RoomStore) CreateRoom(name string, ownerID int64, private bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`INSERT INTO lobby_rooms (name, private, owner_id)
+         VALUES ($1, $2, $3)
+         ON CONFLICT (name) DO NOTHING`,
+		name, private, ownerID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("room already exists")
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO lobby_room_members (room_name, user_id) VALUES ($1, $2)`,
+		name, ownerID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *RoomStore) IsMember(name string, userID int64) (bool, error) {
+	var ok bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM lobby_room_members WHERE room_name = $1 AND user_id = $2)`,
+		name, userID,
+	).Scan(&ok)
+	return ok, err
+}
+
+// CanJoin reports whether the room exists and userID may enter it.
+func (s *RoomStore) CanJoin(name string, userID int64) (bool, error) {
+	room, err := s.GetRoom(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !room.Private {
+		return true, nil
+	}
+	return s.IsMember(name, userID)
+}
+
+func (s *RoomStore) AddMember(name string, userID int64) error {
+	_, err := s.db.Exec(
+		`INSERT INTO lobby_room_members (room_name, user_id)
+         VALUES ($1, $2)
+         ON CONFLICT (room_name, user_id) DO NOTHING`,
+		name, userID,
+	)
+	return err
+}
+
+func (s *RoomStore) RemoveMember(name string, userID int64) error {
+	_, err := s.db.Exec(
+		`DELETE FROM lobby_room_members WHERE room_name = $1 AND user_id = $2`,
+		name, userID,
+	)
+	return err
+}
+
+// Room returns the lobby room the client is currently in.
+func (c *LobbyClient) Room() string {
+	c.roomMu.Lock()
+	defer c.roomMu.Unlock()
+	return c.room
+}
+
+func (c *LobbyClient) setRoom(room string) string {
+	c.roomMu.Lock()
+	defer c.roomMu.Unlock()
+	prev := c.room
+	c.room = room
+	return prev
+}
+
+// lobbyRoomChange tells the hub a client moved rooms. History is the new
+// room's recent chat, already marshalled, to send ahead of the presence list.
+type lobbyRoomChange struct {
+	client  *LobbyClient
+	history [][]byte
+}
+
+type lobbyRoomList struct {
+	client *LobbyClient
+	rooms  []LobbyRoom
+}
+
+func (h *LobbyHub) applyRoomChange(change lobbyRoomChange) {
+	if !h.clients[change.client] {
+		return
+	}
+	// covers both the room the client left and the one it entered
+	h.refreshPresence(change.client.user.ID)
+	for _, msg := range change.history {
+		h.sendTo(change.client, msg)
+	}
+	h.sendSnapshot(change.client)
+}
+
+func (h *LobbyHub) sendRoomList(list lobbyRoomList) {
+	for i := range list.rooms {
+		list.rooms[i].Online = len(h.presence[list.rooms[i].Name])
+	}
+	if list.rooms == nil {
+		list.rooms = []LobbyRoom{}
+	}
+	data, err := json.Marshal(map[string]any{"type": "rooms", "rooms": list.rooms})
+	if err != nil {
+		return
+	}
+	h.sendTo(list.client, data)
+}
+
+// handleRoomMessage runs on the client's read goroutine so the database work
+// stays out of the hub loop.
+func (c *LobbyClient) handleRoomMessage(payload LobbyInbound) {
+	if c.db == nil {
+		return
+	}
+	rooms := NewRoomStore(c.db)
+	name := normalizeRoomName(payload.Room)
+
+	switch payload.Type {
+	case "listRooms":
+		list, err := rooms.ListRooms(c.user.ID)
+		if err != nil {
+			log.Println("ListRooms error:", err)
+			return
+		}
+		c.hub.roomLists <- lobbyRoomList{client: c, rooms: list}
+
+	case "createRoom":
+		if !roomNamePattern.MatchString(name) {
+			c.sendError("room names are 2-32 characters: a-z, 0-9 and -")
+			return
+		}
+		if err := rooms.CreateRoom(name, c.user.ID, payload.Private); err != nil {
+			c.sendError(err.Error())
+			return
+		}
+		c.enterRoom(name)
+
+	case "joinRoom":
+		ok, err := rooms.CanJoin(name, c.user.ID)
+		if err != nil {
+			log.Println("CanJoin error:", err)
+			return
+		}
+		if !ok {
+			c.sendError("room not found")
+			return
+		}
+		if err := rooms.AddMember(name, c.user.ID); err != nil {
+			log.Println("AddMember error:", err)
+		}
+		c.enterRoom(name)
+
+	case "leaveRoom":
+		if name == "" {
+			name = c.Room()
+		}
+		if name == defaultLobbyRoom {
+			return
+		}
+		if err := rooms.RemoveMember(name, c.user.ID); err != nil {
+			log.Println("RemoveMember error:", err)
+		}
+		if c.Room() == name {
+			c.enterRoom(defaultLobbyRoom)
+		}
+
+	case "roomInvite":
+		if payload.TargetUserID == 0 {
+			return
+		}
+		if ok, err := rooms.IsMember(name, c.user.ID); err != nil || !ok {
+			c.sendError("you are not a member of that room")
+			return
+		}
+		if c.unreachable(payload.TargetUserID) {
+			c.sendError("you can't invite this player")
+			return
+		}
+		if err := rooms.AddMember(name, payload.TargetUserID); err != nil {
+			log.Println("AddMember error:", err)
+			c.sendError("failed to invite")
+			return
+		}
+		fromName := c.user.DisplayName
+		if fromName == "" {
+			fromName = c.user.Username
+		}
+		out, err := json.Marshal(map[string]any{
+			"type":       "roomInvite",
+			"room":       name,
+			"fromUserId": c.user.ID,
+			"fromName":   fromName,
+		})
+		if err == nil {
+			c.hub.broadcast <- lobbyOutbound{Data: out, UserIDs: []int64{payload.TargetUserID}}
+		}
+	}
+}
+
+// enterRoom switches the client to room and has the hub replay its chat.
+func (c *LobbyClient) enterRoom(room string) {
+	if c.setRoom(room) == room {
+		return
+	}
+
+	var history [][]byte
+	msgs, err := loadLobbyChat(c.db, c.user.ID, room, 0, lobbyChatJoinHistory)
+	if err != nil {
+		log.Println("loadLobbyChat error:", err)
+	}
+	for _, m := range msgs {
+		if data, err := json.Marshal(m); err == nil {
+			history = append(history, data)
+		}
+	}
+	c.hub.rooms <- lobbyRoomChange{client: c, history: history}
+}
+
+// sendError reports a problem with the client's last request to it alone.
+func (c *LobbyClient) sendError(text string) {
+	data, err := json.Marshal(map[string]string{"type": "error", "text": text})
+	if err != nil {
+		return
+	}
+	c.hub.broadcast <- lobbyOutbound{To: c, Data: data}
+}
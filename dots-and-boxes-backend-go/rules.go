@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"slices"
+)
+
+// =====================
+// Rule Variants
+// =====================
+
+const (
+	variantStandard    = "standard"
+	variantMisere      = "misere"      // fewest boxes wins
+	variantNoExtraTurn = "noExtraTurn" // completing a box doesn't earn another move
+	variantSwedish     = "swedish"     // the border edges start drawn
+	variantMustCapture = "mustCapture" // a box that can be completed must be
+)
+
+var variants = []string{variantStandard, variantMisere, variantNoExtraTurn, variantSwedish, variantMustCapture}
+
+// borderSlot marks edges the rules drew before the first move.
+const borderSlot = "-"
+
+var errMustCapture = errors.New("you must complete a box when you can")
+
+// RuleSet is what differs between variants. The engine asks it about
+// starting edges, move legality, extra turns and final placings.
+type RuleSet interface {
+	Name() string
+	// InitialEdges lists edges drawn before anybody moves.
+	InitialEdges(st *GameState) []edgeRef
+	// Legal rejects a move that is on the board and undrawn but still not
+	// allowed.
+	Legal(st *GameState, e edgeRef) error
+	// ExtraTurn reports whether completing boxes lets the mover go again.
+	ExtraTurn() bool
+	// Places ranks final scores; 1 is the winner and ties share a place.
+	Places(scores []int) []int
+}
+
+func rulesFor(settings GameSettings) RuleSet {
+	switch settings.Variant {
+	case variantMisere:
+		return misereRules{}
+	case variantNoExtraTurn:
+		return noExtraTurnRules{}
+	case variantSwedish:
+		return swedishRules{}
+	case variantMustCapture:
+		return mustCaptureRules{}
+	}
+	return standardRules{}
+}
+
+func validVariant(v string) bool {
+	return slices.Contains(variants, v)
+}
+
+type standardRules struct{}
+
+func (standardRules) Name() string                      { return variantStandard }
+func (standardRules) InitialEdges(*GameState) []edgeRef { return nil }
+func (standardRules) Legal(*GameState, edgeRef) error   { return nil }
+func (standardRules) ExtraTurn() bool                   { return true }
+func (standardRules) Places(scores []int) []int         { return placesFor(scores) }
+
+type misereRules struct{ standardRules }
+
+func (misereRules) Name() string { return variantMisere }
+
+func (misereRules) Places(scores []int) []int {
+	inverted := make([]int, len(scores))
+	for i, s := range scores {
+		inverted[i] = -s
+	}
+	return placesFor(inverted)
+}
+
+type noExtraTurnRules struct{ standardRules }
+
+func (noExtraTurnRules) Name() string    { return variantNoExtraTurn }
+func (noExtraTurnRules) ExtraTurn() bool { return false }
+
+type swedishRules struct{ standardRules }
+
+func (swedishRules) Name() string { return variantSwedish }
+
+// InitialEdges draws the outline of the layout, holes included: every edge
+// with a box on one side only.
+func (swedishRules) InitialEdges(st *GameState) []edgeRef {
+	var edges []edgeRef
+	for _, e := range st.allEdges() {
+		if len(st.boxesBeside(e)) == 1 {
+			edges = append(edges, e)
+		}
+	}
+	return edges
+}
+
+type mustCaptureRules struct{ standardRules }
+
+func (mustCaptureRules) Name() string { return variantMustCapture }
+
+// Legal allows a non-capturing move only when no capture is available.
+func (mustCaptureRules) Legal(st *GameState, e edgeRef) error {
+	if st.completes(e) {
+		return nil
+	}
+	for _, other := range st.allEdges() {
+		if st.Edges[other.id()] == "" && st.completes(other) {
+			return errMustCapture
+		}
+	}
+	return nil
+}
+
+// completes reports whether drawing the undrawn edge e would finish a box.
+func (st *GameState) completes(e edgeRef) bool {
+	for _, b := range st.boxesBeside(e) {
+		missing := 0
+		for _, side := range boxEdges(b[0], b[1]) {
+			if st.Edges[side.id()] == "" {
+				missing++
+			}
+		}
+		if missing == 1 {
+			return true
+		}
+	}
+	return false
+}
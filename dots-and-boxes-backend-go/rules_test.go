@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestRuleSetMoves(t *testing.T) {
+	tests := []struct {
+		variant  string
+		setup    []testMove
+		move     testMove
+		wantErr  error
+		wantTurn string
+	}{
+		{variant: variantStandard, setup: threeSides, move: testMove{"v-0-1", "p2"}, wantTurn: "p2"},
+		{variant: variantMisere, setup: threeSides, move: testMove{"v-0-1", "p2"}, wantTurn: "p2"},
+		{variant: variantNoExtraTurn, setup: threeSides, move: testMove{"v-0-1", "p2"}, wantTurn: "p1"},
+		{variant: variantMustCapture, setup: threeSides, move: testMove{"h-1-1", "p2"}, wantErr: errMustCapture},
+		{variant: variantMustCapture, setup: threeSides, move: testMove{"v-0-1", "p2"}, wantTurn: "p2"},
+		{variant: variantMustCapture, move: testMove{"h-1-1", "p1"}, wantTurn: "p2"},
+		// the outline starts drawn: one inner edge leaves b-0-0 a side short
+		{variant: variantSwedish, move: testMove{"h-0-0", "p1"}, wantErr: errEdgeTaken},
+		{variant: variantSwedish, setup: []testMove{{"h-1-0", "p1"}}, move: testMove{"v-0-1", "p2"}, wantTurn: "p2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.variant+" "+tt.move.edge, func(t *testing.T) {
+			st := newTestState(t, GameSettings{BoardWidth: 2, BoardHeight: 2, Variant: tt.variant})
+			if st.rules.Name() != tt.variant {
+				t.Fatalf("rules = %s, want %s", st.rules.Name(), tt.variant)
+			}
+			playAll(t, st, tt.setup)
+
+			_, err := st.Apply(tt.move.edge, tt.move.slot)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Apply error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && st.Turn != tt.wantTurn {
+				t.Errorf("Turn = %s, want %s", st.Turn, tt.wantTurn)
+			}
+		})
+	}
+}
+
+func TestRuleSetPlaces(t *testing.T) {
+	tests := []struct {
+		variant string
+		scores  []int
+		want    []int
+	}{
+		{variantStandard, []int{3, 1}, []int{1, 2}},
+		{variantStandard, []int{2, 2}, []int{1, 1}},
+		{variantMisere, []int{3, 1}, []int{2, 1}},
+		{variantMisere, []int{0, 4, 4, 1}, []int{1, 3, 3, 2}},
+		{variantNoExtraTurn, []int{1, 3}, []int{2, 1}},
+		{variantSwedish, []int{1, 3}, []int{2, 1}},
+		{variantMustCapture, []int{1, 3}, []int{2, 1}},
+	}
+
+	for _, tt := range tests {
+		got := rulesFor(GameSettings{Variant: tt.variant}).Places(tt.scores)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s Places(%v) = %v, want %v", tt.variant, tt.scores, got, tt.want)
+		}
+	}
+}
+
+func TestSwedishInitialEdges(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout string
+		w, h   int
+		want   int
+	}{
+		{"2x2 rectangle", layoutRectangle, 2, 2, 8},
+		{"3x3 rectangle", layoutRectangle, 3, 3, 12},
+		{"3x3 cross", layoutCross, 3, 3, 12},
+		{"3x3 donut, hole outlined too", layoutDonut, 3, 3, 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newTestState(t, GameSettings{BoardWidth: tt.w, BoardHeight: tt.h, Layout: tt.layout, Variant: variantSwedish})
+			if got := len(st.initialEdgeIDs()); got != tt.want {
+				t.Errorf("initial edges = %d, want %d", got, tt.want)
+			}
+			for _, id := range st.initialEdgeIDs() {
+				if st.Edges[id] != borderSlot {
+					t.Errorf("edge %s = %q, want border", id, st.Edges[id])
+				}
+			}
+		})
+	}
+}
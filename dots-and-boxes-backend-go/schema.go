@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// =====================
+// Schema
+// =====================
+
+// schemaStatements bring an existing database (users, moves, chat_messages)
+// up to date with what the server expects. Every statement must be safe to
+// run on each startup.
+var schemaStatements = []string{
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS rating INTEGER NOT NULL DEFAULT 1200`,
+
+	// lobby rooms
+	`CREATE TABLE IF NOT EXISTS lobby_rooms (
+		name       TEXT PRIMARY KEY,
+		private    BOOLEAN NOT NULL DEFAULT FALSE,
+		owner_id   BIGINT REFERENCES users(id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS lobby_room_members (
+		room_name TEXT NOT NULL REFERENCES lobby_rooms(name) ON DELETE CASCADE,
+		user_id   BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		joined_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (room_name, user_id)
+	)`,
+	`INSERT INTO lobby_rooms (name) VALUES ('general'), ('beginners'), ('team-tournament')
+		ON CONFLICT (name) DO NOTHING`,
+	`ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS room TEXT`,
+	`UPDATE chat_messages SET room = 'general' WHERE room_type = 'lobby' AND room IS NULL`,
+
+	// direct messages
+	`CREATE TABLE IF NOT EXISTS direct_messages (
+		id           BIGSERIAL PRIMARY KEY,
+		sender_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		recipient_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		sender_name  TEXT NOT NULL,
+		message      TEXT NOT NULL,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		read_at      TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS direct_messages_pair_idx
+		ON direct_messages (LEAST(sender_id, recipient_id), GREATEST(sender_id, recipient_id), id)`,
+	`CREATE INDEX IF NOT EXISTS direct_messages_unread_idx
+		ON direct_messages (recipient_id) WHERE read_at IS NULL`,
+
+	// blocks and mutes
+	`CREATE TABLE IF NOT EXISTS user_blocks (
+		user_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		target_id  BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		kind       TEXT NOT NULL CHECK (kind IN ('block', 'mute')),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, target_id, kind)
+	)`,
+	`CREATE INDEX IF NOT EXISTS user_blocks_target_idx ON user_blocks (target_id)`,
+
+	// friends
+	`CREATE TABLE IF NOT EXISTS friendships (
+		requester_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		addressee_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		accepted_at  TIMESTAMPTZ,
+		PRIMARY KEY (requester_id, addressee_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS friendships_addressee_idx ON friendships (addressee_id)`,
+
+	// games
+	`CREATE TABLE IF NOT EXISTS games (
+		id           TEXT PRIMARY KEY,
+		status       TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('pending', 'active', 'finished')),
+		board_width  INTEGER NOT NULL DEFAULT 4,
+		board_height INTEGER NOT NULL DEFAULT 4,
+		rated        BOOLEAN NOT NULL DEFAULT FALSE,
+		player1_id   BIGINT REFERENCES users(id) ON DELETE SET NULL,
+		player2_id   BIGINT REFERENCES users(id) ON DELETE SET NULL,
+		invite_code  TEXT UNIQUE,
+		created_by   BIGINT REFERENCES users(id) ON DELETE SET NULL,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		started_at   TIMESTAMPTZ,
+		finished_at  TIMESTAMPTZ
+	)`,
+	// CREATE TABLE leaves an older games table as it is
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active'
+		CHECK (status IN ('pending', 'active', 'finished'))`,
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS board_width INTEGER NOT NULL DEFAULT 4`,
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS board_height INTEGER NOT NULL DEFAULT 4`,
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS rated BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS player1_id BIGINT REFERENCES users(id) ON DELETE SET NULL`,
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS player2_id BIGINT REFERENCES users(id) ON DELETE SET NULL`,
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS invite_code TEXT UNIQUE`,
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS created_by BIGINT REFERENCES users(id) ON DELETE SET NULL`,
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS started_at TIMESTAMPTZ`,
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS finished_at TIMESTAMPTZ`,
+	`ALTER TABLE moves ADD COLUMN IF NOT EXISTS retracted_at TIMESTAMPTZ`,
+
+	// N-seat games: full settings as JSON, one game_players row per seat
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS settings JSONB`,
+	`CREATE TABLE IF NOT EXISTS game_players (
+		game_id      TEXT NOT NULL REFERENCES games(id) ON DELETE CASCADE,
+		seat         INTEGER NOT NULL CHECK (seat >= 0 AND seat < 4),
+		user_id      BIGINT REFERENCES users(id) ON DELETE SET NULL,
+		color        TEXT,
+		score        INTEGER,
+		place        INTEGER,
+		rating_delta INTEGER,
+		PRIMARY KEY (game_id, seat)
+	)`,
+	`CREATE INDEX IF NOT EXISTS game_players_user_idx ON game_players (user_id)`,
+	// two-player games from before game_players keep their players in
+	// player1_id/player2_id, which nothing writes any more; copy them over
+	// once, for games that have no seats yet
+	`INSERT INTO game_players (game_id, seat, user_id)
+		SELECT g.id, s.seat, CASE s.seat WHEN 0 THEN g.player1_id ELSE g.player2_id END
+		  FROM games g CROSS JOIN (VALUES (0), (1)) AS s (seat)
+		 WHERE NOT EXISTS (SELECT 1 FROM game_players p WHERE p.game_id = g.id)`,
+
+	// team chat in 2v2 games, readable by one team only
+	`ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS team INTEGER`,
+
+	// rotating refresh tokens, one chain per login session
+	`CREATE TABLE IF NOT EXISTS refresh_tokens (
+		token_hash TEXT PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		user_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		used_at    TIMESTAMPTZ,
+		revoked_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS refresh_tokens_session_idx ON refresh_tokens (session_id)`,
+	// hash of the token a refresh swapped this one for
+	`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS replaced_by TEXT`,
+
+	// login sessions: where each refresh-token chain was started
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id           TEXT PRIMARY KEY,
+		user_id      BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		device       TEXT NOT NULL,
+		ip           TEXT NOT NULL,
+		user_agent   TEXT NOT NULL,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		revoked_at   TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id)`,
+
+	// email for account recovery, and single-use password reset tokens
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT`,
+	`CREATE TABLE IF NOT EXISTS password_resets (
+		token_hash TEXT PRIMARY KEY,
+		user_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		ip         TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		used_at    TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS password_resets_user_idx ON password_resets (user_id)`,
+
+	// email verification; an address only belongs to somebody once they
+	// verify it, so typing someone else's can't lock its owner out
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ`,
+	`DROP INDEX IF EXISTS users_email_idx`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_verified_email_idx ON users (lower(email))
+	    WHERE email_verified_at IS NOT NULL`,
+
+	// login lockouts, admins and the security audit log
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id         BIGSERIAL PRIMARY KEY,
+		event      TEXT NOT NULL,
+		user_id    BIGINT REFERENCES users(id) ON DELETE SET NULL,
+		ip         TEXT NOT NULL,
+		detail     TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_user_idx ON audit_log (user_id, created_at)`,
+
+	// registration tokens, shared by every instance
+	`CREATE TABLE IF NOT EXISTS registration_tokens (
+		token      TEXT PRIMARY KEY,
+		ip         TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS registration_tokens_ip_idx ON registration_tokens (ip, expires_at)`,
+	`CREATE INDEX IF NOT EXISTS registration_tokens_expires_idx ON registration_tokens (expires_at)`,
+
+	// public profiles
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS bio TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS country TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS colors JSONB NOT NULL DEFAULT '[]'`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_key TEXT`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_url TEXT`,
+
+	// per-user statistics, updated once per finished game
+	// older moves keep a NULL time; only new rows get the default
+	`ALTER TABLE moves ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ`,
+	`ALTER TABLE moves ALTER COLUMN created_at SET DEFAULT now()`,
+	`ALTER TABLE games ADD COLUMN IF NOT EXISTS stats_recorded_at TIMESTAMPTZ`,
+	`CREATE TABLE IF NOT EXISTS user_stats (
+		user_id       BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		games         INTEGER NOT NULL DEFAULT 0,
+		wins          INTEGER NOT NULL DEFAULT 0,
+		losses        INTEGER NOT NULL DEFAULT 0,
+		draws         INTEGER NOT NULL DEFAULT 0,
+		boxes         INTEGER NOT NULL DEFAULT 0,
+		longest_chain INTEGER NOT NULL DEFAULT 0,
+		moves         INTEGER NOT NULL DEFAULT 0,
+		move_ms       BIGINT NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_board_stats (
+		user_id      BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		board_width  INTEGER NOT NULL,
+		board_height INTEGER NOT NULL,
+		games        INTEGER NOT NULL DEFAULT 0,
+		wins         INTEGER NOT NULL DEFAULT 0,
+		losses       INTEGER NOT NULL DEFAULT 0,
+		draws        INTEGER NOT NULL DEFAULT 0,
+		boxes        INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, board_width, board_height)
+	)`,
+	`CREATE TABLE IF NOT EXISTS head_to_head (
+		low_id    BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		high_id   BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		games     INTEGER NOT NULL DEFAULT 0,
+		low_wins  INTEGER NOT NULL DEFAULT 0,
+		high_wins INTEGER NOT NULL DEFAULT 0,
+		draws     INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (low_id, high_id),
+		CHECK (low_id < high_id)
+	)`,
+
+	// deleted accounts stay behind as anonymous tombstones
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+
+	// usernames are unique whatever their case; skeletons (see
+	// confusableSkeleton) let new display names be checked for look-alikes.
+	// Names that already clash keep their oldest owner; the others get
+	// "-<id>" appended, noted in the audit log, and can still get in
+	// through a password reset by email
+	`WITH renamed AS (
+		UPDATE users u SET username = u.username || '-' || u.id
+		 WHERE EXISTS (SELECT 1 FROM users o WHERE lower(o.username) = lower(u.username) AND o.id < u.id)
+		RETURNING u.id, u.username
+	)
+	INSERT INTO audit_log (event, user_id, ip, detail)
+		SELECT 'username_renamed', id, '', 'duplicate username renamed to ' || username FROM renamed`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_idx ON users (lower(username))`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS username_skeleton TEXT`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS display_skeleton TEXT`,
+	`CREATE INDEX IF NOT EXISTS users_username_skeleton_idx ON users (username_skeleton)`,
+	`CREATE INDEX IF NOT EXISTS users_display_skeleton_idx ON users (display_skeleton)`,
+}
+
+func ensureSchema(db *sql.DB) error {
+	for i, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("schema statement %d: %w", i, err)
+		}
+	}
+	return nil
+}
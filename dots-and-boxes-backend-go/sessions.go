@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// =====================
+// Sessions
+// =====================
+
+// Every login is a session: the refresh-token chain from auth_tokens.go
+// plus where it was started. Users can list their sessions and end any of
+// them remotely.
+
+const maxDeviceNameLength = 64
+
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	Current    bool      `json:"current"`
+}
+
+type SessionStore struct {
+	db *sql.DB
+}
+
+func NewSessionStore(db *sql.DB) *SessionStore {
+	return &SessionStore{db: db}
+}
+
+func (s *SessionStore) Create(userID int64, sess Session) error {
+	_, err := s.db.Exec(
+		`INSERT INTO sessions (id, user_id, device, ip, user_agent)
+         VALUES ($1, $2, $3, $4, $5)`,
+		sess.ID, userID, sess.Device, sess.IP, sess.UserAgent,
+	)
+	return err
+}
+
+// Touch records that the session refreshed its tokens from ip.
+func (s *SessionStore) Touch(sessionID, ip string) error {
+	_, err := s.db.Exec(
+		`UPDATE sessions SET last_seen_at = now(), ip = $2 WHERE id = $1`,
+		sessionID, ip,
+	)
+	return err
+}
+
+// KnownIP reports whether the user has ever had a session from ip.
+func (s *SessionStore) KnownIP(userID int64, ip string) (bool, error) {
+	var known bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM sessions WHERE user_id = $1 AND ip = $2)`,
+		userID, ip,
+	).Scan(&known)
+	return known, err
+}
+
+// List returns the user's live sessions, most recently used first.
+func (s *SessionStore) List(userID int64) ([]Session, error) {
+	rows, err := s.db.Query(
+		`SELECT id, device, ip, user_agent, created_at, last_seen_at
+           FROM sessions
+          WHERE user_id = $1 AND revoked_at IS NULL
+            AND last_seen_at > now() - $2 * interval '1 second'
+          ORDER BY last_seen_at DESC`,
+		userID, int(refreshTokenTTL.Seconds()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var sess Session
+		if err := rows.Scan(&sess.ID, &sess.Device, &sess.IP, &sess.UserAgent, &sess.CreatedAt, &sess.LastSeenAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// Owner returns the user a live session belongs to, or sql.ErrNoRows.
+func (s *SessionStore) Owner(sessionID string) (int64, error) {
+	var userID int64
+	err := s.db.QueryRow(
+		`SELECT user_id FROM sessions WHERE id = $1 AND revoked_at IS NULL`,
+		sessionID,
+	).Scan(&userID)
+	return userID, err
+}
+
+func (s *SessionStore) MarkRevoked(sessionID string) error {
+	_, err := s.db.Exec(
+		`UPDATE sessions SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`,
+		sessionID,
+	)
+	return err
+}
+
+// deviceName labels a session: the name the client sent, or a guess from
+// the User-Agent such as "Firefox on Linux".
+func deviceName(requested, ua string) string {
+	if d := strings.TrimSpace(requested); d != "" {
+		if len(d) > maxDeviceNameLength {
+			d = d[:maxDeviceNameLength]
+		}
+		return d
+	}
+
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	os := ""
+	for _, o := range []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iOS"}, {"iPad", "iPadOS"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			os = o.name
+			break
+		}
+	}
+	if os == "" {
+		return browser
+	}
+	return browser + " on " + os
+}
+
+// startSession records a new login from r and returns its ID.
+func (s *Server) startSession(userID int64, r *http.Request, device string) (string, error) {
+	sess := Session{
+		ID:        newSessionID(),
+		IP:        getIP(r),
+		UserAgent: getUA(r),
+	}
+	sess.Device = deviceName(device, sess.UserAgent)
+	if err := s.sessionStore.Create(userID, sess); err != nil {
+		return "", err
+	}
+	return sess.ID, nil
+}
+
+// GET /auth/sessions (protected) lists where the user is logged in
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+	current, _ := r.Context().Value("sessionId").(string)
+
+	sessions, err := s.sessionStore.List(uid)
+	if err != nil {
+		log.Println("List sessions error:", err)
+		writeError(w, 500, "failed to load sessions")
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	writeJSON(w, 200, map[string]any{"sessions": sessions})
+}
+
+// DELETE /auth/sessions/{id} (protected) logs that session out everywhere
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+	sessionID := r.PathValue("id")
+
+	owner, err := s.sessionStore.Owner(sessionID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != uid) {
+		writeError(w, 404, "session not found")
+		return
+	}
+	if err != nil {
+		log.Println("Owner error:", err)
+		writeError(w, 500, "failed to revoke session")
+		return
+	}
+
+	if err := s.revokeSession(sessionID); err != nil {
+		log.Println("revokeSession error:", err)
+		writeError(w, 500, "failed to revoke session")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
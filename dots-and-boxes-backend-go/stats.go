@@ -0,0 +1,432 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// =====================
+// Player Statistics
+// =====================
+
+// Stats are kept in summary tables that are updated once per finished game,
+// so reading them never scans the moves table. countGame runs right after
+// the result is committed, in its own transaction; games.stats_recorded_at
+// marks counted games, and any left uncounted (finished before the tables
+// existed, or whose count failed) are picked up by backfillStats at
+// startup.
+
+type BoardStats struct {
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	Games    int     `json:"games"`
+	Wins     int     `json:"wins"`
+	Losses   int     `json:"losses"`
+	Draws    int     `json:"draws"`
+	AvgBoxes float64 `json:"avgBoxes"`
+}
+
+type UserStats struct {
+	UserID       int64        `json:"userId"`
+	Games        int          `json:"games"`
+	Wins         int          `json:"wins"`
+	Losses       int          `json:"losses"`
+	Draws        int          `json:"draws"`
+	AvgBoxes     float64      `json:"avgBoxes"`
+	LongestChain int          `json:"longestChain"` // most boxes taken in one run of captures
+	AvgMoveMs    int64        `json:"avgMoveMs"`
+	Boards       []BoardStats `json:"boards"`
+}
+
+type HeadToHead struct {
+	UserA int64 `json:"userA"`
+	UserB int64 `json:"userB"`
+	Games int   `json:"games"`
+	WinsA int   `json:"winsA"`
+	WinsB int   `json:"winsB"`
+	Draws int   `json:"draws"`
+}
+
+type StatsStore struct {
+	db *sql.DB
+}
+
+func NewStatsStore(db *sql.DB) *StatsStore {
+	return &StatsStore{db: db}
+}
+
+func (s *StatsStore) UserStats(userID int64) (*UserStats, error) {
+	st := &UserStats{UserID: userID, Boards: []BoardStats{}}
+	var boxes, moves int
+	var moveMs int64
+	err := s.db.QueryRow(
+		`SELECT games, wins, losses, draws, boxes, longest_chain, moves, move_ms
+           FROM user_stats WHERE user_id = $1`,
+		userID,
+	).Scan(&st.Games, &st.Wins, &st.Losses, &st.Draws, &boxes, &st.LongestChain, &moves, &moveMs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st.AvgBoxes = average(boxes, st.Games)
+	if moves > 0 {
+		st.AvgMoveMs = moveMs / int64(moves)
+	}
+
+	rows, err := s.db.Query(
+		`SELECT board_width, board_height, games, wins, losses, draws, boxes
+           FROM user_board_stats WHERE user_id = $1
+          ORDER BY games DESC, board_width, board_height`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b BoardStats
+		var boxes int
+		if err := rows.Scan(&b.Width, &b.Height, &b.Games, &b.Wins, &b.Losses, &b.Draws, &boxes); err != nil {
+			return nil, err
+		}
+		b.AvgBoxes = average(boxes, b.Games)
+		st.Boards = append(st.Boards, b)
+	}
+	return st, rows.Err()
+}
+
+// HeadToHead returns a's record against b, from a's point of view.
+func (s *StatsStore) HeadToHead(a, b int64) (*HeadToHead, error) {
+	lo, hi := min(a, b), max(a, b)
+	h := &HeadToHead{UserA: a, UserB: b}
+	var loWins, hiWins int
+	err := s.db.QueryRow(
+		`SELECT games, low_wins, high_wins, draws FROM head_to_head
+          WHERE low_id = $1 AND high_id = $2`,
+		lo, hi,
+	).Scan(&h.Games, &loWins, &hiWins, &h.Draws)
+	if errors.Is(err, sql.ErrNoRows) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.WinsA, h.WinsB = loWins, hiWins
+	if a != lo {
+		h.WinsA, h.WinsB = hiWins, loWins
+	}
+	return h, nil
+}
+
+func average(total, n int) float64 {
+	if n == 0 {
+		return 0
+	}
+	return float64(int(float64(total)/float64(n)*100+0.5)) / 100
+}
+
+// seatOutcome is 1 for a win, 0 for a draw (sharing first place with an
+// opponent) and -1 for a loss. Teammates sharing a place don't make a draw.
+func seatOutcome(settings GameSettings, places []int, seat int) int {
+	if places[seat] != 1 {
+		return -1
+	}
+	for other, place := range places {
+		if other != seat && place == 1 && !teammates(settings, seat, other) {
+			return 0
+		}
+	}
+	return 1
+}
+
+func teammates(settings GameSettings, a, b int) bool {
+	return settings.Teams != nil && settings.Teams[a] == settings.Teams[b]
+}
+
+// seatPlay is what one seat did over the moves of a game.
+type seatPlay struct {
+	longestChain int
+	moves        int
+	moveMs       int64
+}
+
+// replayForStats replays a game's moves to find each seat's longest chain
+// of captures and time spent per move (since the previous move, or the
+// game's start for the first one). Moves stored before timestamps were
+// kept have none, so neither they nor the move after them are timed.
+func replayForStats(g *Game, moves []statsMove, startedAt sql.NullTime) []seatPlay {
+	plays := make([]seatPlay, g.Settings.Seats)
+	st := NewGameState(g.Settings, g.PlayerIDs)
+
+	runSlot, run := "", 0
+	prev := startedAt.Time
+	for _, m := range moves {
+		completed, err := st.Apply(m.EdgeID, m.PlayerSlot)
+		if err != nil {
+			continue
+		}
+		seat, _ := strconv.Atoi(m.PlayerSlot[1:])
+		seat--
+
+		if m.At.Valid && !prev.IsZero() && m.At.Time.After(prev) {
+			plays[seat].moves++
+			plays[seat].moveMs += m.At.Time.Sub(prev).Milliseconds()
+		}
+		prev = m.At.Time
+
+		if len(completed) == 0 || m.PlayerSlot != runSlot {
+			run = 0
+		}
+		runSlot = m.PlayerSlot
+		run += len(completed)
+		plays[seat].longestChain = max(plays[seat].longestChain, run)
+	}
+	return plays
+}
+
+type statsMove struct {
+	EdgeID     string
+	PlayerSlot string
+	At         sql.NullTime
+}
+
+// countGame records a finished game's stats in a transaction of its own,
+// so a failure here never undoes the result. Games left uncounted are
+// picked up by backfillStats on the next start.
+func countGame(db *sql.DB, gameID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordGameStats(tx, gameID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordGameStats adds a finished game to the summary tables. It does
+// nothing for games already counted or finished without a result.
+func recordGameStats(tx *sql.Tx, gameID string) error {
+	var startedAt sql.NullTime
+	err := tx.QueryRow(
+		`UPDATE games SET stats_recorded_at = now()
+          WHERE id = $1 AND status = 'finished' AND stats_recorded_at IS NULL
+          RETURNING started_at`,
+		gameID,
+	).Scan(&startedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	g, err := scanGame(tx.QueryRow(`SELECT `+gameColumns+` FROM games WHERE id = $1`, gameID))
+	if err != nil {
+		return err
+	}
+	if err := loadSeats(tx, g); err != nil {
+		return err
+	}
+
+	scores := make([]int, g.Settings.Seats)
+	places := make([]int, g.Settings.Seats)
+	rows, err := tx.Query(`SELECT seat, score, place FROM game_players WHERE game_id = $1`, gameID)
+	if err != nil {
+		return err
+	}
+	complete := 0
+	for rows.Next() {
+		var seat int
+		var score, place sql.NullInt64
+		if err := rows.Scan(&seat, &score, &place); err != nil {
+			rows.Close()
+			return err
+		}
+		if seat < len(scores) && score.Valid && place.Valid {
+			scores[seat], places[seat] = int(score.Int64), int(place.Int64)
+			complete++
+		}
+	}
+	rows.Close()
+	if complete != len(scores) {
+		return nil // abandoned or never played out
+	}
+
+	var moves []statsMove
+	rows, err = tx.Query(
+		`SELECT edge_id, player_slot, created_at FROM moves
+          WHERE game_id = $1 AND retracted_at IS NULL
+          ORDER BY id ASC`,
+		gameID,
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var m statsMove
+		if err := rows.Scan(&m.EdgeID, &m.PlayerSlot, &m.At); err != nil {
+			rows.Close()
+			return err
+		}
+		moves = append(moves, m)
+	}
+	rows.Close()
+	plays := replayForStats(g, moves, startedAt)
+
+	for seat, userID := range g.PlayerIDs {
+		if userID == 0 {
+			continue
+		}
+		var win, loss, draw int
+		switch seatOutcome(g.Settings, places, seat) {
+		case 1:
+			win = 1
+		case -1:
+			loss = 1
+		default:
+			draw = 1
+		}
+		p := plays[seat]
+		if _, err := tx.Exec(
+			`INSERT INTO user_stats (user_id, games, wins, losses, draws, boxes, longest_chain, moves, move_ms)
+             VALUES ($1, 1, $2, $3, $4, $5, $6, $7, $8)
+             ON CONFLICT (user_id) DO UPDATE SET
+                 games         = user_stats.games + 1,
+                 wins          = user_stats.wins + $2,
+                 losses        = user_stats.losses + $3,
+                 draws         = user_stats.draws + $4,
+                 boxes         = user_stats.boxes + $5,
+                 longest_chain = GREATEST(user_stats.longest_chain, $6),
+                 moves         = user_stats.moves + $7,
+                 move_ms       = user_stats.move_ms + $8`,
+			userID, win, loss, draw, scores[seat], p.longestChain, p.moves, p.moveMs,
+		); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO user_board_stats (user_id, board_width, board_height, games, wins, losses, draws, boxes)
+             VALUES ($1, $2, $3, 1, $4, $5, $6, $7)
+             ON CONFLICT (user_id, board_width, board_height) DO UPDATE SET
+                 games  = user_board_stats.games + 1,
+                 wins   = user_board_stats.wins + $4,
+                 losses = user_board_stats.losses + $5,
+                 draws  = user_board_stats.draws + $6,
+                 boxes  = user_board_stats.boxes + $7`,
+			userID, g.Settings.BoardWidth, g.Settings.BoardHeight, win, loss, draw, scores[seat],
+		); err != nil {
+			return err
+		}
+	}
+
+	// every pair of opponents, the better place wins
+	for a := range g.PlayerIDs {
+		for b := a + 1; b < len(g.PlayerIDs); b++ {
+			ua, ub := g.PlayerIDs[a], g.PlayerIDs[b]
+			if ua == 0 || ub == 0 || ua == ub || teammates(g.Settings, a, b) {
+				continue
+			}
+			lo, hi, loPlace, hiPlace := ua, ub, places[a], places[b]
+			if ub < ua {
+				lo, hi, loPlace, hiPlace = ub, ua, places[b], places[a]
+			}
+			var loWin, hiWin, draw int
+			switch {
+			case loPlace < hiPlace:
+				loWin = 1
+			case hiPlace < loPlace:
+				hiWin = 1
+			default:
+				draw = 1
+			}
+			if _, err := tx.Exec(
+				`INSERT INTO head_to_head (low_id, high_id, games, low_wins, high_wins, draws)
+                 VALUES ($1, $2, 1, $3, $4, $5)
+                 ON CONFLICT (low_id, high_id) DO UPDATE SET
+                     games     = head_to_head.games + 1,
+                     low_wins  = head_to_head.low_wins + $3,
+                     high_wins = head_to_head.high_wins + $4,
+                     draws     = head_to_head.draws + $5`,
+				lo, hi, loWin, hiWin, draw,
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// backfillStats counts finished games that the summary tables don't know
+// about yet, one transaction per game.
+func backfillStats(db *sql.DB) {
+	rows, err := db.Query(
+		`SELECT id FROM games WHERE status = 'finished' AND stats_recorded_at IS NULL ORDER BY finished_at`,
+	)
+	if err != nil {
+		log.Println("backfillStats error:", err)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := countGame(db, id); err != nil {
+			log.Println("backfillStats", id, "error:", err)
+		}
+	}
+	if len(ids) > 0 {
+		log.Println("backfillStats: checked", len(ids), "games")
+	}
+}
+
+// GET /api/users/{id}/stats
+func (s *Server) handleUserStats(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, 400, "invalid user id")
+		return
+	}
+	if _, err := s.userStore.GetUserByID(userID); errors.Is(err, sql.ErrNoRows) {
+		writeError(w, 404, "user not found")
+		return
+	}
+
+	st, err := s.statsStore.UserStats(userID)
+	if err != nil {
+		log.Println("UserStats error:", err)
+		writeError(w, 500, "failed to load stats")
+		return
+	}
+	writeJSON(w, 200, st)
+}
+
+// GET /api/users/{a}/vs/{b}
+func (s *Server) handleHeadToHead(w http.ResponseWriter, r *http.Request) {
+	a, errA := strconv.ParseInt(r.PathValue("a"), 10, 64)
+	b, errB := strconv.ParseInt(r.PathValue("b"), 10, 64)
+	if errA != nil || errB != nil || a == b {
+		writeError(w, 400, "invalid user ids")
+		return
+	}
+
+	h, err := s.statsStore.HeadToHead(a, b)
+	if err != nil {
+		log.Println("HeadToHead error:", err)
+		writeError(w, 500, "failed to load stats")
+		return
+	}
+	writeJSON(w, 200, h)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+)
+
+// =====================
+// Game State Cache & Takebacks
+// =====================
+
+// gameStates holds the live board of every game with an open socket. Each
+// game has its own lock, which serialises its moves so two clicks can't
+// race each other; games never wait on each other's database work.
+type gameStates struct {
+	mu     sync.Mutex // guards states, never held during database work
+	states map[string]*liveGame
+}
+
+type liveGame struct {
+	mu        sync.Mutex
+	st        *GameState // nil until loaded
+	users     int        // with calls holding or waiting for mu
+	forgotten bool       // drop once the last user is done
+}
+
+func newGameStates() *gameStates {
+	return &gameStates{states: make(map[string]*liveGame)}
+}
+
+// with runs fn on the game's state, loading it from the database first if
+// this is the first time the game is touched since it was last forgotten.
+func (gs *gameStates) with(db *sql.DB, gameID string, fn func(st *GameState)) {
+	gs.mu.Lock()
+	g, ok := gs.states[gameID]
+	if !ok {
+		g = &liveGame{}
+		gs.states[gameID] = g
+	}
+	g.users++
+	gs.mu.Unlock()
+
+	g.mu.Lock()
+	if g.st == nil {
+		g.st = loadGameState(db, gameID)
+	}
+	fn(g.st)
+	g.mu.Unlock()
+
+	gs.mu.Lock()
+	g.users--
+	if g.users == 0 && g.forgotten {
+		delete(gs.states, gameID)
+	}
+	gs.mu.Unlock()
+}
+
+// forget drops the game's state, or has the last caller still using it
+// drop it, so the next touch reloads it.
+func (gs *gameStates) forget(gameID string) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	g, ok := gs.states[gameID]
+	if !ok {
+		return
+	}
+	if g.users == 0 {
+		delete(gs.states, gameID)
+		return
+	}
+	g.forgotten = true
+}
+
+// loadGameState rebuilds a board from the games and moves tables. Games the
+// database doesn't know (the demo board) get default settings.
+func loadGameState(db *sql.DB, gameID string) *GameState {
+	players := gameRegistry.Players(gameID)
+	settings := GameSettings{Seats: max(len(players), minSeats)}
+	settings.normalize()
+	finished := false
+
+	if db != nil {
+		g, err := NewGameStore(db).GetGame(gameID)
+		switch {
+		case err == nil:
+			settings = g.Settings
+			players = g.PlayerIDs
+			finished = g.Status == "finished"
+		case !errors.Is(err, sql.ErrNoRows):
+			log.Println("GetGame error:", err)
+		}
+	}
+
+	st := NewGameState(settings, players)
+	moves, err := loadMoves(db, gameID)
+	if err != nil {
+		log.Println("loadMoves error:", err)
+	}
+	st.Replay(moves)
+	// a finished game with boxes left was resigned
+	st.resigned = finished && !st.Over()
+	return st
+}
+
+func retractMovesFrom(db *sql.DB, gameID string, fromMoveID int64) error {
+	if db == nil {
+		return nil
+	}
+	_, err := db.Exec(
+		`UPDATE moves SET retracted_at = now()
+          WHERE game_id = $1 AND id >= $2 AND retracted_at IS NULL`,
+		gameID, fromMoveID,
+	)
+	return err
+}
+
+type takebackRequest struct {
+	userID    int64
+	scope     string         // "move" or "turn"
+	moveCount int            // board must be unchanged when the answer arrives
+	accepted  map[int64]bool // other players who agreed so far
+}
+
+// seatedOthers counts the seated players besides userID.
+func (st *GameState) seatedOthers(userID int64) int {
+	n := 0
+	for _, id := range st.PlayerIDs {
+		if id != 0 && id != userID {
+			n++
+		}
+	}
+	return n
+}
+
+// handleTakeback deals with "takebackRequest", "takebackAccept" and
+// "takebackDecline". Takebacks are only allowed in unrated games, and need
+// every other seated player to accept.
+func (c *GameClient) handleTakeback(kind, scope string) {
+	var out *GameMove
+	var errText string
+
+	c.hub.states.with(c.db, c.gameID, func(st *GameState) {
+		slot := st.SlotFor(c.userID)
+		if slot == "" {
+			return
+		}
+		if st.Settings.Rated {
+			errText = "takebacks are only allowed in unrated games"
+			return
+		}
+		if st.Over() {
+			errText = errGameOver.Error()
+			return
+		}
+
+		switch kind {
+		case "takebackRequest":
+			n := len(st.Moves)
+			if n == 0 || st.Moves[n-1].PlayerSlot != slot {
+				errText = "you can only take back your own last move"
+				return
+			}
+			if scope != "turn" {
+				scope = "move"
+			}
+			st.takeback = &takebackRequest{
+				userID:    c.userID,
+				scope:     scope,
+				moveCount: n,
+				accepted:  make(map[int64]bool),
+			}
+			out = &GameMove{Type: "takebackOffer", GameID: c.gameID, UserID: c.userID, Scope: scope}
+
+		case "takebackDecline":
+			if st.takeback == nil || st.takeback.userID == c.userID {
+				return
+			}
+			st.takeback = nil
+			out = &GameMove{Type: "takebackDeclined", GameID: c.gameID, UserID: c.userID}
+
+		case "takebackAccept":
+			req := st.takeback
+			if req == nil || req.userID == c.userID || req.moveCount != len(st.Moves) {
+				return
+			}
+			req.accepted[c.userID] = true
+			if len(req.accepted) < st.seatedOthers(req.userID) {
+				out = &GameMove{Type: "takebackAccepted", GameID: c.gameID, UserID: c.userID}
+				return
+			}
+
+			cut := len(st.Moves) - 1
+			if req.scope == "turn" {
+				cut = st.lastTurnStart()
+			}
+			if c.db != nil && st.Moves[cut].ID == 0 {
+				errText = "failed to take back move"
+				return
+			}
+			if err := retractMovesFrom(c.db, c.gameID, st.Moves[cut].ID); err != nil {
+				log.Println("retractMovesFrom error:", err)
+				errText = "failed to take back move"
+				return
+			}
+
+			rebuilt := NewGameState(st.Settings, st.PlayerIDs)
+			rebuilt.Replay(st.Moves[:cut])
+			*st = *rebuilt
+
+			snap := st.Snapshot(c.gameID)
+			out = &snap
+		}
+	})
+
+	if errText != "" {
+		c.hub.replies <- gameReply{client: c, move: GameMove{Type: "error", GameID: c.gameID, Text: errText}}
+	}
+	if out != nil {
+		c.hub.broadcast <- *out
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestUndoLast(t *testing.T) {
+	st := newTestState(t, GameSettings{BoardWidth: 2, BoardHeight: 2})
+	playAll(t, st, append(append([]testMove{}, threeSides...), testMove{"v-0-1", "p2"}))
+
+	st.undoLast()
+	if len(st.Moves) != 3 || st.Edges["v-0-1"] != "" || len(st.Boxes) != 0 || st.Turn != "p2" {
+		t.Fatalf("after undoLast: moves=%d edge=%q boxes=%v turn=%s", len(st.Moves), st.Edges["v-0-1"], st.Boxes, st.Turn)
+	}
+}
+
+func TestLastTurnStart(t *testing.T) {
+	teams := GameSettings{BoardWidth: 2, BoardHeight: 2, Seats: 4, Teams: []int{0, 0, 1, 1}, ExtraTurn: extraTurnPartner}
+
+	tests := []struct {
+		name     string
+		settings GameSettings
+		moves    []testMove
+		want     int
+	}{
+		{
+			name:     "no capture",
+			settings: GameSettings{BoardWidth: 2, BoardHeight: 2},
+			moves:    threeSides,
+			want:     2,
+		},
+		{
+			name:     "mover goes again",
+			settings: GameSettings{BoardWidth: 2, BoardHeight: 2},
+			moves:    append(append([]testMove{}, threeSides...), testMove{"v-0-1", "p2"}, testMove{"h-0-1", "p2"}),
+			want:     3,
+		},
+		{
+			// p4 completes b-0-0 and the extra move passes to p3
+			name:     "partner takes the extra move",
+			settings: teams,
+			moves: []testMove{
+				{"h-0-0", "p1"}, {"h-1-0", "p3"}, {"v-0-0", "p2"}, {"v-0-1", "p4"}, {"h-0-1", "p3"},
+			},
+			want: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.settings.normalize(); err != nil {
+				t.Fatalf("normalize: %v", err)
+			}
+			st := NewGameState(tt.settings, []int64{1, 2, 3, 4}[:tt.settings.Seats])
+			playAll(t, st, tt.moves)
+			if got := st.lastTurnStart(); got != tt.want {
+				t.Fatalf("lastTurnStart() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// =====================
+// Teams (2v2)
+// =====================
+
+// Team games have four seats split into teams 0 and 1. Turns alternate
+// between the teams (A1, B1, A2, B2 by default); scores and results are
+// per team.
+
+const (
+	extraTurnMover   = "mover"   // completing a box lets the mover go again
+	extraTurnPartner = "partner" // completing a box hands the turn to the teammate
+)
+
+const teamSeats = 4
+
+// checkTeams validates team assignments before the turn order is filled in.
+func (gs *GameSettings) checkTeams() error {
+	if len(gs.Teams) == 0 {
+		gs.Teams = nil
+		if gs.ExtraTurn != "" && gs.ExtraTurn != extraTurnMover {
+			return errors.New("extraTurn only applies to team games")
+		}
+		return nil
+	}
+
+	if gs.Seats != teamSeats || len(gs.Teams) != teamSeats {
+		return errors.New("team games have 4 seats in 2 teams of 2")
+	}
+	var size [2]int
+	for _, t := range gs.Teams {
+		if t != 0 && t != 1 {
+			return errors.New("teams must be 0 or 1")
+		}
+		size[t]++
+	}
+	if size[0] != 2 || size[1] != 2 {
+		return errors.New("team games have 4 seats in 2 teams of 2")
+	}
+
+	switch gs.ExtraTurn {
+	case "":
+		gs.ExtraTurn = extraTurnMover
+	case extraTurnMover, extraTurnPartner:
+	default:
+		return errors.New("extraTurn must be mover or partner")
+	}
+	return nil
+}
+
+// defaultTurnOrder is seat order, or A1, B1, A2, B2 for team games.
+func (gs *GameSettings) defaultTurnOrder() []int {
+	order := make([]int, 0, gs.Seats)
+	if gs.Teams == nil {
+		for i := range gs.Seats {
+			order = append(order, i)
+		}
+		return order
+	}
+
+	var members [2][]int
+	for seat, t := range gs.Teams {
+		members[t] = append(members[t], seat)
+	}
+	for i := range members[0] {
+		order = append(order, members[0][i], members[1][i])
+	}
+	return order
+}
+
+// alternatesTeams reports whether no team ever moves twice in a row.
+func (gs *GameSettings) alternatesTeams() bool {
+	if gs.Teams == nil {
+		return true
+	}
+	for i, seat := range gs.TurnOrder {
+		next := gs.TurnOrder[(i+1)%len(gs.TurnOrder)]
+		if gs.Teams[seat] == gs.Teams[next] {
+			return false
+		}
+	}
+	return true
+}
+
+// teamOfSeat returns the seat's team, or -1 outside team games.
+func (gs *GameSettings) teamOfSeat(seat int) int {
+	if seat < 0 || seat >= len(gs.Teams) {
+		return -1
+	}
+	return gs.Teams[seat]
+}
+
+// TeamOf returns userID's team, or -1 if there are no teams or they aren't
+// seated.
+func (st *GameState) TeamOf(userID int64) int {
+	for seat, id := range st.PlayerIDs {
+		if id != 0 && id == userID {
+			return st.Settings.teamOfSeat(seat)
+		}
+	}
+	return -1
+}
+
+// Teammates lists the seated players on team, including the caller.
+func (st *GameState) Teammates(team int) []int64 {
+	var ids []int64
+	for seat, id := range st.PlayerIDs {
+		if id != 0 && st.Settings.teamOfSeat(seat) == team {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// partnerSlot is the slot of the other seat on slot's team.
+func (st *GameState) partnerSlot(slot string) string {
+	for seat := range st.Settings.Teams {
+		if seatSlot(seat) == slot {
+			for other, t := range st.Settings.Teams {
+				if other != seat && t == st.Settings.Teams[seat] {
+					return seatSlot(other)
+				}
+			}
+		}
+	}
+	return slot
+}
+
+// teamScores sums seat scores per team, nil outside team games.
+func teamScores(settings GameSettings, scores []int) []int {
+	if settings.Teams == nil {
+		return nil
+	}
+	totals := make([]int, 2)
+	for seat, score := range scores {
+		if t := settings.teamOfSeat(seat); t >= 0 {
+			totals[t] += score
+		}
+	}
+	return totals
+}
+
+// teamResults gives each teammate their team's place and, from the team's
+// average rating, their team's rating change.
+func teamResults(settings GameSettings, scores, ratings []int, resigned int) (places, deltas []int) {
+	totals := teamScores(settings, scores)
+	teamPlaces := rulesFor(settings).Places(totals)
+	if resigned >= 0 {
+		teamPlaces = resignedLast(teamPlaces, settings.Teams[resigned])
+	}
+
+	teamRatings := make([]int, 2)
+	for seat, r := range ratings {
+		teamRatings[settings.Teams[seat]] += r
+	}
+	for t := range teamRatings {
+		teamRatings[t] /= 2
+	}
+	teamDeltas := multiEloDeltas(teamRatings, teamPlaces)
+
+	places = make([]int, len(scores))
+	deltas = make([]int, len(scores))
+	for seat := range scores {
+		places[seat] = teamPlaces[settings.Teams[seat]]
+		deltas[seat] = teamDeltas[settings.Teams[seat]]
+	}
+	return places, deltas
+}
+
+// saveTeamChat stores a message only the given team may read back.
+func saveTeamChat(db *sql.DB, gameID string, team int, userID int64, displayName, text string) error {
+	if db == nil {
+		return nil
+	}
+	_, err := db.Exec(
+		`INSERT INTO chat_messages (game_id, user_id, display_name, message, room_type, team)
+         VALUES ($1, $2, $3, $4, 'team', $5)`,
+		gameID, userID, displayName, text, team,
+	)
+	return err
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// =====================
+// Validation
+// =====================
+
+// FieldError is one problem with one request field. Codes are stable so
+// the frontend can translate them; Message is a readable fallback.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors []FieldError
+
+func (ve ValidationErrors) Error() string {
+	msgs := make([]string, len(ve))
+	for i, fe := range ve {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (ve *ValidationErrors) add(field, code, message string) {
+	*ve = append(*ve, FieldError{Field: field, Code: code, Message: message})
+}
+
+// writeValidation answers 400 with every field error.
+func writeValidation(w http.ResponseWriter, errs ValidationErrors) {
+	writeJSON(w, 400, map[string]any{
+		"error":       errs.Error(),
+		"fieldErrors": errs,
+	})
+}
+
+// ValidationRules are the account field policies. Defaults can be
+// overridden with VALIDATION_* environment variables.
+type ValidationRules struct {
+	UsernameMin     int
+	UsernameMax     int
+	UsernamePattern *regexp.Regexp
+	ReservedNames   map[string]bool
+
+	DisplayNameMin int
+	DisplayNameMax int
+
+	PasswordMin     int
+	PasswordMax     int // bcrypt ignores everything past 72 bytes
+	CommonPasswords map[string]bool
+}
+
+var validationRules = loadValidationRules()
+
+func loadValidationRules() ValidationRules {
+	r := ValidationRules{
+		UsernameMin:     3,
+		UsernameMax:     20,
+		UsernamePattern: regexp.MustCompile(`^[a-zA-Z0-9_]+$`),
+		ReservedNames:   toSet(reservedNames),
+
+		DisplayNameMin: 1,
+		DisplayNameMax: 32,
+
+		PasswordMin:     8,
+		PasswordMax:     72,
+		CommonPasswords: toSet(commonPasswords),
+	}
+
+	envInt := func(name string, dst *int) {
+		if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+			*dst = n
+		}
+	}
+	envInt("VALIDATION_USERNAME_MIN", &r.UsernameMin)
+	envInt("VALIDATION_USERNAME_MAX", &r.UsernameMax)
+	envInt("VALIDATION_DISPLAY_NAME_MAX", &r.DisplayNameMax)
+	envInt("VALIDATION_PASSWORD_MIN", &r.PasswordMin)
+	for _, name := range strings.Split(os.Getenv("VALIDATION_RESERVED_NAMES"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			r.ReservedNames[name] = true
+		}
+	}
+	return r
+}
+
+func toSet(words []string) map[string]bool {
+	set := make(map[string]bool, len(words))
+	for _, w := range words {
+		set[w] = true
+	}
+	return set
+}
+
+var reservedNames = []string{
+	"admin", "administrator", "root", "system", "moderator", "mod", "support",
+	"staff", "official", "server", "bot", "api", "null", "undefined", "anonymous",
+	"player", "guest", "dotsandboxes",
+}
+
+// commonPasswords is a short list of the passwords that top every leak.
+var commonPasswords = []string{
+	"password", "password1", "password123", "12345678", "123456789", "1234567890",
+	"qwerty123", "qwertyuiop", "11111111", "00000000", "iloveyou", "sunshine",
+	"princess", "football", "baseball", "welcome1", "letmein1", "abc12345",
+	"trustno1", "superman", "starwars", "passw0rd", "dragon123", "monkey123",
+	"1q2w3e4r", "zaq12wsx", "asdfghjkl", "changeme", "dotsandboxes",
+}
+
+// Username checks a login name: ASCII letters, digits and underscores only.
+// Usernames are unique regardless of case (see users_username_lower_idx);
+// look-alikes such as "admin" and "adm1n" are caught on display names,
+// which are what other players see.
+func (r ValidationRules) Username(username string) ValidationErrors {
+	var errs ValidationErrors
+	switch {
+	case len(username) < r.UsernameMin || len(username) > r.UsernameMax:
+		errs.add("username", "length", "must be "+strconv.Itoa(r.UsernameMin)+" to "+strconv.Itoa(r.UsernameMax)+" characters")
+	case !r.UsernamePattern.MatchString(username):
+		errs.add("username", "charset", "may only contain letters, digits and underscores")
+	case r.ReservedNames[strings.ToLower(username)]:
+		errs.add("username", "reserved", "is reserved")
+	}
+	return errs
+}
+
+// DisplayName normalizes a display name (NFKC, trimmed, inner whitespace
+// collapsed) and checks it. Names that mix alphabets or imitate a reserved
+// name are rejected as confusable.
+func (r ValidationRules) DisplayName(name string) (string, ValidationErrors) {
+	var errs ValidationErrors
+	name = strings.Join(strings.Fields(norm.NFKC.String(name)), " ")
+
+	n := utf8.RuneCountInString(name)
+	if n < r.DisplayNameMin || n > r.DisplayNameMax {
+		errs.add("displayName", "length", "must be "+strconv.Itoa(r.DisplayNameMin)+" to "+strconv.Itoa(r.DisplayNameMax)+" characters")
+		return name, errs
+	}
+	for _, ch := range name {
+		if unicode.IsControl(ch) || unicode.Is(unicode.Cf, ch) {
+			errs.add("displayName", "charset", "contains invisible or control characters")
+			return name, errs
+		}
+	}
+	if mixedScripts(name) {
+		errs.add("displayName", "confusable", "mixes letters from different alphabets")
+		return name, errs
+	}
+	skeleton := confusableSkeleton(name)
+	for reserved := range r.ReservedNames {
+		if skeleton == confusableSkeleton(reserved) {
+			errs.add("displayName", "reserved", "looks like a reserved name")
+			break
+		}
+	}
+	return name, errs
+}
+
+// Password checks strength. username may be empty when it isn't known.
+func (r ValidationRules) Password(password, username string) ValidationErrors {
+	var errs ValidationErrors
+	switch {
+	case len(password) < r.PasswordMin:
+		errs.add("password", "length", "must be at least "+strconv.Itoa(r.PasswordMin)+" characters")
+	case len(password) > r.PasswordMax:
+		errs.add("password", "length", "must be at most "+strconv.Itoa(r.PasswordMax)+" bytes")
+	case r.CommonPasswords[strings.ToLower(password)]:
+		errs.add("password", "common", "is too common")
+	case username != "" && strings.EqualFold(password, username):
+		errs.add("password", "username", "must not be the username")
+	case strings.Count(password, password[:1]) == len(password):
+		errs.add("password", "weak", "must not repeat one character")
+	}
+	return errs
+}
+
+// mixedScripts reports whether name has letters from more than one of
+// Latin, Cyrillic and Greek, the usual homoglyph mix.
+func mixedScripts(name string) bool {
+	seen := 0
+	for _, script := range []*unicode.RangeTable{unicode.Latin, unicode.Cyrillic, unicode.Greek} {
+		for _, ch := range name {
+			if unicode.Is(script, ch) {
+				seen++
+				break
+			}
+		}
+	}
+	return seen > 1
+}
+
+// confusables maps look-alike characters to the Latin letter they imitate.
+var confusables = map[rune]rune{
+	'а': 'a', 'е': 'e', 'о': 'o', 'р': 'p', 'с': 'c', 'х': 'x', 'у': 'y', 'і': 'i', 'ј': 'j', 'ѕ': 's',
+	'α': 'a', 'ε': 'e', 'ο': 'o', 'ρ': 'p', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'τ': 't',
+	'0': 'o', '1': 'l', '3': 'e', '5': 's', '@': 'a', '$': 's', '|': 'l',
+}
+
+// confusableSkeleton lowercases name, maps look-alikes and drops
+// everything that isn't a letter, so "Αdm1n" and "a d m i n" compare equal
+// to "admin" (with 'l' and 'i' folded together).
+func confusableSkeleton(name string) string {
+	var b strings.Builder
+	for _, ch := range strings.ToLower(name) {
+		if c, ok := confusables[ch]; ok {
+			ch = c
+		}
+		if ch == 'l' {
+			ch = 'i'
+		}
+		if unicode.IsLetter(ch) {
+			b.WriteRune(ch)
+		}
+	}
+	return strings.ReplaceAll(b.String(), "rn", "m")
+}
+
+// LookalikeTaken reports whether another live account's username or
+// display name has the given skeleton.
+func (s *UserStore) LookalikeTaken(skeleton string, exceptID int64) (bool, error) {
+	var taken bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM users
+                         WHERE id <> $2 AND deleted_at IS NULL
+                           AND (username_skeleton = $1 OR display_skeleton = $1))`,
+		skeleton, exceptID,
+	).Scan(&taken)
+	return taken, err
+}
+
+// checkLookalikeName rejects a display name that could pass for another
+// player's. exceptID is the user picking it (0 while registering).
+func (s *Server) checkLookalikeName(name string, exceptID int64) ValidationErrors {
+	skeleton := confusableSkeleton(name)
+	if skeleton == "" {
+		return nil
+	}
+	taken, err := s.userStore.LookalikeTaken(skeleton, exceptID)
+	if err != nil {
+		log.Println("LookalikeTaken error:", err)
+	}
+	var errs ValidationErrors
+	if taken {
+		errs.add("displayName", "confusable", "looks like another player's name")
+	}
+	return errs
+}
+
+// backfillNameSkeletons fills in skeletons for accounts created before
+// they were stored.
+func backfillNameSkeletons(db *sql.DB) {
+	rows, err := db.Query(
+		`SELECT id, username, display_name FROM users
+          WHERE deleted_at IS NULL AND (username_skeleton IS NULL OR display_skeleton IS NULL)`,
+	)
+	if err != nil {
+		log.Println("backfillNameSkeletons error:", err)
+		return
+	}
+	type names struct {
+		id                    int64
+		username, displayName string
+	}
+	var pending []names
+	for rows.Next() {
+		var n names
+		if err := rows.Scan(&n.id, &n.username, &n.displayName); err == nil {
+			pending = append(pending, n)
+		}
+	}
+	rows.Close()
+
+	for _, n := range pending {
+		if _, err := db.Exec(
+			`UPDATE users SET username_skeleton = $2, display_skeleton = $3 WHERE id = $1`,
+			n.id, confusableSkeleton(n.username), confusableSkeleton(n.displayName),
+		); err != nil {
+			log.Println("backfillNameSkeletons", n.id, "error:", err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// codes lists the error codes in order, "" for none.
+func codes(errs ValidationErrors) string {
+	var out []string
+	for _, fe := range errs {
+		out = append(out, fe.Code)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestValidationRulesUsername(t *testing.T) {
+	rules := loadValidationRules()
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{"alice_1", ""},
+		{"ab", "length"},
+		{strings.Repeat("a", 21), "length"},
+		{"al ice", "charset"},
+		{"ålice", "charset"},
+		{"admin", "reserved"},
+		{"ADMIN", "reserved"},
+	}
+
+	for _, tt := range tests {
+		if got := codes(rules.Username(tt.username)); got != tt.want {
+			t.Errorf("Username(%q) = %q, want %q", tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestValidationRulesDisplayName(t *testing.T) {
+	rules := loadValidationRules()
+	tests := []struct {
+		name       string
+		in         string
+		wantName   string
+		wantErrors string
+	}{
+		{"plain", "Bob", "Bob", ""},
+		{"whitespace collapsed", "  Bob \t  Smith ", "Bob Smith", ""},
+		{"NFKC folds fullwidth", "Ａｌｉｃｅ", "Alice", ""},
+		{"empty", "   ", "", "length"},
+		{"too long", strings.Repeat("x", 33), strings.Repeat("x", 33), "length"},
+		{"zero-width space", "Bo​b", "Bo​b", "charset"},
+		{"mixed alphabets", "Pаypal", "Pаypal", "confusable"},
+		{"reserved look-alike", "Adm1n", "Adm1n", "reserved"},
+		{"reserved with spaces", "a d m i n", "a d m i n", "reserved"},
+		{"single alphabet Cyrillic", "Иван", "Иван", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, errs := rules.DisplayName(tt.in)
+			if name != tt.wantName {
+				t.Errorf("name = %q, want %q", name, tt.wantName)
+			}
+			if got := codes(errs); got != tt.wantErrors {
+				t.Errorf("errors = %q, want %q", got, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestValidationRulesPassword(t *testing.T) {
+	rules := loadValidationRules()
+	tests := []struct {
+		password, username string
+		want               string
+	}{
+		{"correct horse battery", "alice", ""},
+		{"short", "", "length"},
+		{strings.Repeat("ab", 37), "", "length"},
+		{"Password123", "", "common"},
+		{"alice_smith", "Alice_Smith", "username"},
+		{"zzzzzzzzzz", "", "weak"},
+	}
+
+	for _, tt := range tests {
+		if got := codes(rules.Password(tt.password, tt.username)); got != tt.want {
+			t.Errorf("Password(%q, %q) = %q, want %q", tt.password, tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestValidationRulesFromEnv(t *testing.T) {
+	t.Setenv("VALIDATION_USERNAME_MIN", "5")
+	t.Setenv("VALIDATION_PASSWORD_MIN", "12")
+	t.Setenv("VALIDATION_RESERVED_NAMES", " Referee ,")
+
+	rules := loadValidationRules()
+	tests := []struct {
+		name string
+		errs ValidationErrors
+		want string
+	}{
+		{"username min", rules.Username("abcd"), "length"},
+		{"extra reserved name", rules.Username("referee"), "reserved"},
+		{"built-in reserved names stay", rules.Username("admin"), "reserved"},
+		{"password min", rules.Password("elevenchars", ""), "length"},
+	}
+	for _, tt := range tests {
+		if got := codes(tt.errs); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// =====================
+// Email Verification
+// =====================
+
+// Verification links carry a signed token (a JWT with purpose
+// "verifyEmail") for the address it was sent to, so changing the email
+// invalidates older links. With REQUIRE_VERIFIED_EMAIL=true only verified
+// accounts may play rated games or send and accept challenges.
+
+const emailVerifyTTL = 48 * time.Hour
+
+var requireVerifiedEmail = os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true"
+
+var (
+	errVerifyInvalid    = errors.New("invalid or expired verification link")
+	errVerifiedRequired = errors.New("verify your email address first")
+	errEmailTaken       = errors.New("email already in use")
+)
+
+func generateVerifyToken(userID int64, email string) (string, error) {
+	return jwtKeys.sign(jwt.MapClaims{
+		"purpose": "verifyEmail",
+		"userId":  userID,
+		"email":   strings.ToLower(email),
+		"exp":     time.Now().UTC().Add(emailVerifyTTL).Unix(),
+		"iat":     time.Now().UTC().Unix(),
+	})
+}
+
+func parseVerifyToken(tokenStr string) (int64, string, error) {
+	token, err := jwt.Parse(tokenStr, jwtKeys.keyFunc, jwt.WithValidMethods(jwtKeys.methods()))
+	if err != nil || !token.Valid {
+		return 0, "", errVerifyInvalid
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	purpose, _ := claims["purpose"].(string)
+	userID, ok := claims["userId"].(float64)
+	email, _ := claims["email"].(string)
+	if purpose != "verifyEmail" || !ok || email == "" {
+		return 0, "", errVerifyInvalid
+	}
+	return int64(userID), email, nil
+}
+
+// IsVerified reports whether the user's current email has been verified.
+func (s *UserStore) IsVerified(userID int64) (bool, error) {
+	var verified bool
+	err := s.db.QueryRow(
+		`SELECT email IS NOT NULL AND email_verified_at IS NOT NULL FROM users WHERE id = $1`,
+		userID,
+	).Scan(&verified)
+	return verified, err
+}
+
+// MarkVerified verifies email for userID if it is still their address.
+// It fails with errEmailTaken if another account verified it first.
+func (s *UserStore) MarkVerified(userID int64, email string) (bool, error) {
+	res, err := s.db.Exec(
+		`UPDATE users SET email_verified_at = now()
+          WHERE id = $1 AND lower(email) = $2 AND email_verified_at IS NULL`,
+		userID, email,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "users_verified_email_idx") {
+			return false, errEmailTaken
+		}
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// SetEmail changes the address and clears its verification. An address
+// another account has verified is refused with errEmailTaken.
+func (s *UserStore) SetEmail(userID int64, email string) error {
+	res, err := s.db.Exec(
+		`UPDATE users SET email = $2, email_verified_at = NULL
+          WHERE id = $1
+            AND NOT EXISTS (SELECT 1 FROM users o
+                             WHERE o.id <> $1 AND lower(o.email) = lower($2) AND o.email_verified_at IS NOT NULL)`,
+		userID, email,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errEmailTaken
+	}
+	return nil
+}
+
+func (s *UserStore) Email(userID int64) (string, error) {
+	var email sql.NullString
+	err := s.db.QueryRow(`SELECT email FROM users WHERE id = $1`, userID).Scan(&email)
+	return email.String, err
+}
+
+// sendVerification mails a verification link for email.
+func (s *Server) sendVerification(userID int64, email string) error {
+	token, err := generateVerifyToken(userID, email)
+	if err != nil {
+		return err
+	}
+	link := strings.TrimRight(os.Getenv("PUBLIC_API_URL"), "/") + "/auth/verify?token=" + token
+	body := "Welcome to Dots and Boxes!\n\n" +
+		"Confirm your email address by opening this link within 48 hours:\n" +
+		link + "\n\n" +
+		"If you didn't create an account, ignore this email."
+	return s.mailer.Send(email, "Confirm your email address", body)
+}
+
+// mayPlayRated reports whether the verified-only rule lets userID play
+// rated games and challenges.
+func (s *Server) mayPlayRated(userID int64) bool {
+	if !requireVerifiedEmail {
+		return true
+	}
+	verified, err := s.userStore.IsVerified(userID)
+	if err != nil {
+		log.Println("IsVerified error:", err)
+	}
+	return verified
+}
+
+// mayChallenge is the lobby side of the verified-only rule. It asks the
+// database each time, so verifying (or changing the address) takes effect
+// without reconnecting.
+func (c *LobbyClient) mayChallenge() bool {
+	if !requireVerifiedEmail || c.db == nil {
+		return true
+	}
+	verified, err := NewUserStore(c.db).IsVerified(c.user.ID)
+	if err != nil {
+		log.Println("IsVerified error:", err)
+	}
+	if !verified {
+		c.sendError(errVerifiedRequired.Error())
+		return false
+	}
+	return true
+}
+
+// RatedInvite reports whether the pending invite game is rated.
+func (s *GameStore) RatedInvite(code string) (bool, error) {
+	var rated bool
+	err := s.db.QueryRow(
+		`SELECT rated FROM games WHERE invite_code = $1 AND status = 'pending'`,
+		code,
+	).Scan(&rated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return rated, err
+}
+
+// GET /auth/verify?token=... confirms an email address from the mailed link
+func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	uid, email, err := parseVerifyToken(r.URL.Query().Get("token"))
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+
+	if _, err := s.userStore.MarkVerified(uid, email); errors.Is(err, errEmailTaken) {
+		writeError(w, 409, err.Error())
+		return
+	} else if err != nil {
+		log.Println("MarkVerified error:", err)
+		writeError(w, 500, "failed to verify email")
+		return
+	}
+	// A link for an address the user has since changed is not an error
+	// worth showing; report what the account looks like now.
+	verified, err := s.userStore.IsVerified(uid)
+	if err != nil {
+		log.Println("IsVerified error:", err)
+	}
+	if !verified {
+		writeError(w, 400, errVerifyInvalid.Error())
+		return
+	}
+	writeJSON(w, 200, map[string]any{"verified": true})
+}
+
+type setEmailReq struct {
+	Email string `json:"email"`
+}
+
+// POST /auth/email (protected) sets a new address and mails a link for it;
+// an empty body resends the link for the current address. Each call counts
+// against the account and the IP, so it can't be used to send mail in bulk.
+func (s *Server) handleSetEmail(w http.ResponseWriter, r *http.Request) {
+	uid := r.Context().Value("userId").(int64)
+
+	ipKey, accountKey := ipLimitKey(getIP(r)), "account:"+strconv.FormatInt(uid, 10)
+	if limited(w, s.emailLimiter, ipKey, accountKey) {
+		return
+	}
+	s.emailLimiter.Fail(ipKey)
+	s.emailLimiter.Fail(accountKey)
+
+	var req setEmailReq
+	json.NewDecoder(r.Body).Decode(&req)
+	email := strings.TrimSpace(req.Email)
+
+	if email == "" {
+		current, err := s.userStore.Email(uid)
+		if err != nil {
+			log.Println("Email error:", err)
+			writeError(w, 500, "failed to send verification")
+			return
+		}
+		if current == "" {
+			writeError(w, 400, "no email address on this account")
+			return
+		}
+		if verified, _ := s.userStore.IsVerified(uid); verified {
+			writeJSON(w, 200, map[string]any{"verified": true})
+			return
+		}
+		email = current
+	} else {
+		if !strings.Contains(email, "@") {
+			writeError(w, 400, "invalid email")
+			return
+		}
+		if err := s.userStore.SetEmail(uid, email); err != nil {
+			if errors.Is(err, errEmailTaken) {
+				writeError(w, 409, err.Error())
+				return
+			}
+			log.Println("SetEmail error:", err)
+			writeError(w, 500, "failed to set email")
+			return
+		}
+	}
+
+	if err := s.sendVerification(uid, email); err != nil {
+		log.Println("sendVerification error:", err)
+		writeError(w, 500, "failed to send verification")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"verified": false, "sent": true})
+}
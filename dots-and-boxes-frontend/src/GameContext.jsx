@@ -11,6 +11,9 @@ const GameContext = createContext(null);
 const NUM_BOXES_X = 4;
 const NUM_BOXES_Y = 4;
 
+// claimedBy for edges the variant draws before anyone moves (Swedish borders)
+export const BORDER = "border";
+
 function generateEdges() {
   const edges = {};
 
@@ -194,6 +197,19 @@ export function GameProvider({ children }) {
     applyMove(edgeId);
   }
 
+  // Pre-drawn edges belong to nobody and don't change the turn.
+  function drawInitialEdges(edgeIds) {
+    setEdges((prevEdges) => {
+      const updatedEdges = { ...prevEdges };
+      edgeIds.forEach((id) => {
+        if (updatedEdges[id]) {
+          updatedEdges[id] = { ...updatedEdges[id], claimedBy: BORDER };
+        }
+      });
+      return updatedEdges;
+    });
+  }
+
   function resetGame() {
     setEdges(generateEdges());
     setBoxes(generateBoxes());
@@ -217,6 +233,7 @@ export function GameProvider({ children }) {
       numDotsY: NUM_BOXES_Y + 1,
     },
     applyMove,
+    drawInitialEdges,
     handleEdgeClick,
     resetGame,
   };
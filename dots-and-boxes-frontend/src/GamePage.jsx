@@ -20,13 +20,16 @@ export default function GamePage() {
   const [gameEnded, setGameEnded] = useState(false);
   const [endReason, setEndReason] = useState("");
   const [statusMessage, setStatusMessage] = useState("");
+  const [rematchOfferedBy, setRematchOfferedBy] = useState(null);
 
   const {
     players,
     currentPlayerId,
     playerIndex,
     setPlayerIndex,
-    applyMove
+    applyMove,
+    drawInitialEdges,
+    resetGame
   } = useGame();
 
   const wsRef = useRef(null);
@@ -72,6 +75,14 @@ export default function GamePage() {
     console.log("Loaded player index for this tab:", idx);
   }, [location.state, gameId, setPlayerIndex, navigate]);
 
+  // A rematch reuses this page under a new gameId: start from a clean board
+  useEffect(() => {
+    setGameEnded(false);
+    setEndReason("");
+    setRematchOfferedBy(null);
+    resetGame();
+  }, [gameId]);
+
   // 🔹 2. Game WebSocket for receiving moves + chat + endGame
   useEffect(() => {
     if (!token || !gameId) return;
@@ -98,9 +109,30 @@ export default function GamePage() {
           applyMove(msg.edgeId, msg.playerSlot);
         } else if (msg.type === "chat" && msg.gameId === gameId) {
           setChatMessages((prev) => [...prev, msg]);
+        } else if (msg.type === "state" && msg.gameId === gameId) {
+          // Server rewrote the board (e.g. accepted takeback): replay it
+          // on top of the edges the variant starts with
+          resetGame();
+          drawInitialEdges(msg.initialEdges || []);
+          (msg.moves || []).forEach((m) => applyMove(m.edgeId, m.playerSlot));
+        } else if (msg.type === "error" && msg.gameId === gameId) {
+          showWarning(msg.text);
         } else if (msg.type === "endGame" && msg.gameId === gameId) {
           setGameEnded(true);
           setEndReason(msg.text || "Game ended.");
+        } else if (msg.type === "gameOver" && msg.gameId === gameId) {
+          setGameEnded(true);
+          setEndReason((prev) => prev || "Game over.");
+        } else if (msg.type === "rematchOffer" && msg.gameId === gameId) {
+          setRematchOfferedBy(msg.userId);
+          if (msg.userId !== (user?.id ?? user?.userId)) {
+            showWarning("Your opponent wants a rematch.");
+          }
+        } else if (msg.type === "rematchDeclined" && msg.gameId === gameId) {
+          setRematchOfferedBy(null);
+          showWarning("Rematch declined.");
+        } else if (msg.type === "rematchStart" && msg.gameId === gameId) {
+          handleRematchStart(msg);
         }
       } catch (err) {
         console.error("invalid game ws msg", err);
@@ -110,7 +142,7 @@ export default function GamePage() {
     ws.onclose = () => console.log("Game WebSocket closed");
 
     return () => ws.close();
-  }, [token, gameId, applyMove]);
+  }, [token, gameId, applyMove, drawInitialEdges, resetGame]);
 
   function showWarning(msg) {
     setStatusMessage(msg);
@@ -200,6 +232,33 @@ export default function GamePage() {
     // setEndReason("Game ended by you");
   }
 
+  function handleRematchStart(msg) {
+    const userId = user?.id ?? user?.userId ?? null;
+    const players = msg.playerIds || [];
+    const idx = players.indexOf(userId);
+    if (!msg.newGameId || idx === -1) return;
+
+    localStorage.setItem(
+      `game-role:${msg.newGameId}`,
+      JSON.stringify({ gameId: msg.newGameId, playerIndex: idx, players })
+    );
+    navigate(`/game/${msg.newGameId}`, { state: { playerIndex: idx } });
+  }
+
+  // The first click offers a rematch, once offered it accepts
+  function handleRematchClick() {
+    if (!wsRef.current || wsRef.current.readyState !== WebSocket.OPEN) {
+      console.warn("Game WS not open");
+      return;
+    }
+    wsRef.current.send(
+      JSON.stringify({
+        type: rematchOfferedBy ? "rematchAccept" : "rematch",
+        gameId,
+      })
+    );
+  }
+
   function handleReturnToLobby() {
     navigate("/lobby");
   }
@@ -247,6 +306,17 @@ export default function GamePage() {
         {gameEnded && (
           <div className="end-game-banner">
             <p>{endReason || "Game ended by a player"}</p>
+            <button
+              className="to-lobby-btn"
+              onClick={handleRematchClick}
+              disabled={rematchOfferedBy === (user?.id ?? user?.userId)}
+            >
+              {rematchOfferedBy === null
+                ? "Rematch"
+                : rematchOfferedBy === (user?.id ?? user?.userId)
+                ? "Rematch offered"
+                : "Accept Rematch"}
+            </button>
             <button className="to-lobby-btn" onClick={handleReturnToLobby}>
               Back to Lobby
             </button>
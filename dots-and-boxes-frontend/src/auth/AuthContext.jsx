@@ -5,8 +5,33 @@ const AuthContext = createContext(null);
 // Adjust if your API is on another host/port
 const API_BASE = import.meta.env.VITE_API_BASE || "http://localhost:8090";
 
+// Find a solution so that SHA-256(challenge + ":" + solution) starts with
+// `difficulty` zero bits.
+async function solveChallenge(challenge, difficulty) {
+  const encoder = new TextEncoder();
+  for (let i = 0; ; i++) {
+    const digest = new Uint8Array(
+      await crypto.subtle.digest("SHA-256", encoder.encode(`${challenge}:${i}`))
+    );
+    let zeros = 0;
+    for (const byte of digest) {
+      if (byte === 0) {
+        zeros += 8;
+        continue;
+      }
+      zeros += Math.clz32(byte) - 24;
+      break;
+    }
+    if (zeros >= difficulty) return String(i);
+  }
+}
+
 export function AuthProvider({ children }) {
   const [token, setToken] = useState(() => localStorage.getItem("authToken"));
+  const [refreshToken, setRefreshToken] = useState(() =>
+    localStorage.getItem("refreshToken")
+  );
+  const [expiresIn, setExpiresIn] = useState(null);
   const [user, setUser] = useState(() => {
     const raw = localStorage.getItem("authUser");
     return raw ? JSON.parse(raw) : null;
@@ -22,6 +47,40 @@ export function AuthProvider({ children }) {
     }
   }, [token]);
 
+  useEffect(() => {
+    if (refreshToken) {
+      localStorage.setItem("refreshToken", refreshToken);
+    } else {
+      localStorage.removeItem("refreshToken");
+    }
+  }, [refreshToken]);
+
+  // Access tokens are short-lived: swap the refresh token for a new pair a
+  // minute before expiry (or right away after a page reload).
+  useEffect(() => {
+    if (!refreshToken) return;
+    const delay = expiresIn ? Math.max(expiresIn - 60, 5) * 1000 : 0;
+    const timer = setTimeout(async () => {
+      try {
+        const res = await fetch(`${API_BASE}/auth/refresh`, {
+          method: "POST",
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify({ refreshToken }),
+        });
+        if (!res.ok) throw new Error("refresh failed");
+        const data = await res.json();
+        setToken(data.token);
+        setRefreshToken(data.refreshToken);
+        setExpiresIn(data.expiresIn);
+      } catch {
+        setToken(null);
+        setRefreshToken(null);
+        setUser(null);
+      }
+    }, delay);
+    return () => clearTimeout(timer);
+  }, [refreshToken, expiresIn]);
+
   useEffect(() => {
     if (user) {
       localStorage.setItem("authUser", JSON.stringify(user));
@@ -33,10 +92,21 @@ export function AuthProvider({ children }) {
   async function register({ username, password, displayName }) {
     setLoading(true);
     try {
-      // 1. Get registration token (nonce)
+      // 1. Solve the proof-of-work puzzle, then get a registration token
+      const challengeRes = await fetch(`${API_BASE}/auth/register-challenge`);
+      if (!challengeRes.ok) {
+        throw new Error("Failed to obtain registration challenge");
+      }
+      const challenge = await challengeRes.json();
+      const solution = challenge.difficulty
+        ? await solveChallenge(challenge.challenge, challenge.difficulty)
+        : "";
+
       const tokenRes = await fetch(`${API_BASE}/auth/register-token`, {
         method: "POST",
-        });
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ challenge: challenge.challenge, solution }),
+      });
       if (!tokenRes.ok) {
         throw new Error("Failed to obtain registration token");
       }
@@ -82,6 +152,8 @@ export function AuthProvider({ children }) {
 
       const data = await res.json();
       setToken(data.token);
+      setRefreshToken(data.refreshToken);
+      setExpiresIn(data.expiresIn);
       setUser(data.user);
       return true;
     } finally {
@@ -90,7 +162,16 @@ export function AuthProvider({ children }) {
   }
 
   function logout() {
+    if (refreshToken) {
+      fetch(`${API_BASE}/auth/logout`, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ refreshToken }),
+      }).catch(() => {});
+    }
     setToken(null);
+    setRefreshToken(null);
+    setExpiresIn(null);
     setUser(null);
   }
 
@@ -1,6 +1,6 @@
 // src/components/Board.jsx
 import React from "react";
-import { useGame } from "../GameContext";
+import { BORDER, useGame } from "../GameContext";
 
 const SVG_SIZE = 500;
 const PADDING = 30; // extra white space around the grid
@@ -97,9 +97,12 @@ export default function Board({ onEdgeClick }) {
       {/* Clickable edges */}
       {Object.values(edges).map((edge) => {
   const { x1, y1, x2, y2 } = edgePosition(edge);
-  const ownerColor = edge.claimedBy
-    ? players[edge.claimedBy].color
-    : "#ccc";
+  const ownerColor =
+    edge.claimedBy === BORDER
+      ? "#333"
+      : edge.claimedBy
+      ? players[edge.claimedBy].color
+      : "#ccc";
 
   return (
     <g key={edge.id}>
@@ -6,6 +6,37 @@ import { useNavigate } from "react-router-dom";
 const WS_URL =
   (import.meta.env.VITE_WS_BASE || "ws://localhost:8090") + "/ws/lobby";
 
+// Rule variants the server knows (see rules.go).
+const VARIANTS = [
+  { id: "standard", label: "Standard" },
+  { id: "misere", label: "Misère (fewest boxes wins)" },
+  { id: "noExtraTurn", label: "No extra turn" },
+  { id: "swedish", label: "Swedish (borders drawn)" },
+  { id: "mustCapture", label: "Must capture" },
+];
+
+function variantLabel(id) {
+  const v = VARIANTS.find((v) => v.id === (id || "standard"));
+  return v ? v.label : id;
+}
+
+// Joined / left / changed entries arrive as diffs after the first snapshot.
+function applyPresenceDiff(players, diff) {
+  const left = new Set(diff.left || []);
+  const updates = new Map();
+  [...(diff.joined || []), ...(diff.changed || [])].forEach((p) =>
+    updates.set(p.userId, p)
+  );
+
+  const next = players
+    .filter((p) => !left.has(p.userId))
+    .map((p) => updates.get(p.userId) || p);
+  updates.forEach((p, id) => {
+    if (!next.some((q) => q.userId === id)) next.push(p);
+  });
+  return next;
+}
+
 export default function LobbyChat() {
   const { token, user } = useAuth();
   const navigate = useNavigate();
@@ -15,6 +46,7 @@ export default function LobbyChat() {
   const [players, setPlayers] = useState([]);
   const [input, setInput] = useState("");
   const [incomingOffer, setIncomingOffer] = useState(null);
+  const [variant, setVariant] = useState("standard");
   const wsRef = useRef(null);
 
   useEffect(() => {
@@ -35,8 +67,14 @@ export default function LobbyChat() {
           setMessages((prev) => [...prev, msg]);
         } else if (msg.type === "presence") {
           setPlayers(msg.users || []);
+        } else if (msg.type === "presenceDiff") {
+          setPlayers((prev) => applyPresenceDiff(prev, msg));
         } else if (msg.type === "challengeOffer") {
           handleChallengeOffer(msg);
+        } else if (msg.type === "challengeCancelled") {
+          setIncomingOffer((offer) =>
+            offer && offer.challengeId === msg.challengeId ? null : offer
+          );
         } else if (msg.type === "startGame") {
           handleStartGame(msg);
         }
@@ -62,9 +100,11 @@ export default function LobbyChat() {
     if (msg.targetUserId === currentUserId) {
       // I am being challenged
       setIncomingOffer({
+        challengeId: msg.challengeId,
         fromUserId: msg.fromUserId,
         fromName: msg.fromName,
         targetUserId: msg.targetUserId,
+        variant: msg.settings?.variant,
       });
     } else if (msg.fromUserId === currentUserId) {
       // I sent the challenge
@@ -73,7 +113,9 @@ export default function LobbyChat() {
         {
           type: "chat",
           displayName: "System",
-          text: `Challenge sent to player ${msg.targetUserId}`,
+          text: `Challenge sent to player ${msg.targetUserId} (${variantLabel(
+            msg.settings?.variant
+          )})`,
         },
       ]);
     }
@@ -134,6 +176,7 @@ export default function LobbyChat() {
     const payload = {
       type: "challenge",
       targetUserId,
+      settings: { variant },
     };
     wsRef.current.send(JSON.stringify(payload));
   }
@@ -148,13 +191,25 @@ export default function LobbyChat() {
 
     const payload = {
       type: "challengeAccept",
-      opponentUserId: incomingOffer.fromUserId,
+      challengeId: incomingOffer.challengeId,
     };
     wsRef.current.send(JSON.stringify(payload));
     setIncomingOffer(null);
   }
 
   function declineOffer() {
+    if (
+      incomingOffer &&
+      wsRef.current &&
+      wsRef.current.readyState === WebSocket.OPEN
+    ) {
+      wsRef.current.send(
+        JSON.stringify({
+          type: "challengeDecline",
+          challengeId: incomingOffer.challengeId,
+        })
+      );
+    }
     setIncomingOffer(null);
   }
 
@@ -163,6 +218,16 @@ export default function LobbyChat() {
       {/* Players panel */}
       <div className="lobby-players-panel">
         <h2>Players in Lobby</h2>
+        <label className="lobby-variant-picker">
+          Variant{" "}
+          <select value={variant} onChange={(e) => setVariant(e.target.value)}>
+            {VARIANTS.map((v) => (
+              <option key={v.id} value={v.id}>
+                {v.label}
+              </option>
+            ))}
+          </select>
+        </label>
         {players.length === 0 ? (
           <p className="lobby-players-empty">No other players yet.</p>
         ) : (
@@ -173,7 +238,7 @@ export default function LobbyChat() {
                   {p.displayName}
                   <span style={{ opacity: 0.6, fontSize: "0.75rem" }}>
                     {" "}
-                    (id: {p.userId})
+                    (id: {p.userId}, {p.rating}) · {p.status}
                   </span>
                 </span>
                 {currentUserId && currentUserId !== p.userId ? (
@@ -202,7 +267,7 @@ export default function LobbyChat() {
           <div className="lobby-challenge-banner">
             <p>
               <strong>{incomingOffer.fromName}</strong> challenged you to a
-              game.
+              game ({variantLabel(incomingOffer.variant)}).
             </p>
             <div className="lobby-challenge-actions">
               <button onClick={acceptOffer}>Accept</button>